@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// segmentArchive keeps the raw segments of a download for -save-segments,
+// in dir/<stream ID>/ next to the init segment
+type segmentArchive struct {
+	dir string
+
+	mu      sync.Mutex
+	streams [2]*archivedStream
+	err     error // First write that failed
+}
+
+// archivedStream is where the segments of one stream go
+type archivedStream struct {
+	dir   string
+	width int // Digits of the highest index, so the names sort in order
+}
+
+// use makes stream the one whose segments of its kind are saved, creating
+// its directory and writing the init segment
+func (a *segmentArchive) use(kind StreamKind, stream *Stream) error {
+	if stream == nil {
+		return nil
+	}
+	dir := filepath.Join(a.dir, stream.ID)
+	if stream.ID == "" {
+		dir = filepath.Join(a.dir, kind.String())
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("saving segments: %w", err)
+	}
+	if stream.InitSegment != "" {
+		initData, err := base64.StdEncoding.DecodeString(stream.InitSegment)
+		if err != nil {
+			return fmt.Errorf("failed to decode init segment: %w", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "init.mp4"), initData, 0644); err != nil {
+			return fmt.Errorf("saving segments: %w", err)
+		}
+	}
+
+	a.mu.Lock()
+	a.streams[kind] = &archivedStream{dir: dir, width: len(strconv.Itoa(max(len(stream.Segments)-1, 0)))}
+	a.mu.Unlock()
+	return nil
+}
+
+// save is called from a Downloader SegmentFunc. A failed write is kept for
+// failed to report once the download is over.
+func (a *segmentArchive) save(kind StreamKind, index int, data []byte) {
+	a.mu.Lock()
+	stream := a.streams[kind]
+	a.mu.Unlock()
+	if stream == nil {
+		return
+	}
+
+	name := fmt.Sprintf("seg-%0*d.m4s", stream.width, index)
+	if err := os.WriteFile(filepath.Join(stream.dir, name), data, 0644); err != nil {
+		a.mu.Lock()
+		if a.err == nil {
+			a.err = fmt.Errorf("saving segments: %w", err)
+		}
+		a.mu.Unlock()
+	}
+}
+
+// failed returns the first write that failed, if any
+func (a *segmentArchive) failed() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.err
+}
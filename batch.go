@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// BatchEntry is one download listed in a -batch file
+type BatchEntry struct {
+	URL        string
+	OutputFile string // Empty to derive the name from the video
+}
+
+// parseBatchFile reads one URL per line, optionally followed by
+// "|output.mp4". Blank lines and lines starting with # are skipped.
+func parseBatchFile(r io.Reader) ([]BatchEntry, error) {
+	var entries []BatchEntry
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		entry := BatchEntry{URL: line}
+		if i := strings.LastIndex(line, "|"); i >= 0 {
+			entry.URL = strings.TrimSpace(line[:i])
+			entry.OutputFile = strings.TrimSpace(line[i+1:])
+		}
+		if entry.URL == "" {
+			return nil, fmt.Errorf("line %d: missing URL", lineNum)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// BatchResult records the outcome of one batch entry
+type BatchResult struct {
+	Entry BatchEntry
+	Err   error
+	Hook  HookResult
+}
+
+// runBatch downloads each entry in turn using opts for everything but the
+// URL and output file. Unless continueOnError is set it stops at the first
+// failure. The returned results cover the entries that were attempted.
+//
+// With -mux-workers, each entry is muxed in the background while the next
+// one downloads, and mux failures are added to the results at the end.
+//
+// With -parallel-videos, up to that many entries download at once, their
+// segment requests sharing one budget of -c slots. A failure then stops
+// new entries from starting while the running ones finish.
+func runBatch(opts Options, entries []BatchEntry, continueOnError bool) []BatchResult {
+	var queue *muxQueue
+	if opts.MuxWorkers > 0 {
+		queue = newMuxQueue(opts.MuxWorkers)
+		opts.muxQueue = queue
+	}
+
+	// Entries share cookies and segment query tokens by host, and the
+	// configs and playlists of entries that repeat a URL
+	opts.session = newSession(opts.client)
+	defer func() {
+		hits, misses := opts.session.stats()
+		logger.Debug("session cache", "hits", hits, "misses", misses)
+	}()
+
+	parallel := max(opts.ParallelVideos, 1)
+	if parallel > 1 {
+		budget := opts.Concurrent
+		if opts.PerStreamConcurrency {
+			budget *= 2
+		}
+		opts.segmentSlots = make(chan struct{}, budget)
+		// Prompts of videos downloading at once would get mixed up
+		if !opts.Overwrite {
+			opts.NoOverwrite = true
+		}
+		// Only the results and problems of each video are told apart
+		// among the interleaved messages
+		if logLevel == slog.LevelInfo {
+			setLogLevel(LevelResult)
+			defer setLogLevel(slog.LevelInfo)
+		}
+		if opts.Progress == ProgressBar && !opts.Quiet {
+			progress := newBatchProgress(os.Stdout, entries)
+			prevOut, prevErrOut := logOut, logErrOut
+			setLogOutputs(progress.writer(prevOut), progress.writer(prevErrOut))
+			defer setLogOutputs(prevOut, prevErrOut)
+			defer progress.stop()
+			opts.batchProgress = progress
+		}
+	}
+
+	results := make([]BatchResult, len(entries))
+	workers := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	var stopped atomic.Bool
+	attempted := 0
+	for i, entry := range entries {
+		workers <- struct{}{}
+		if (stopped.Load() || queue.failed()) && !continueOnError {
+			if remaining := len(entries) - i; remaining > 0 {
+				warnf("Stopping batch, %d entries not attempted (use -continue-on-error to keep going)", remaining)
+			}
+			break
+		}
+		attempted++
+
+		infof("\n[%d/%d] %s", i+1, len(entries), entry.URL)
+		entryOpts := opts
+		entryOpts.PlaylistURL = entry.URL
+		entryOpts.OutputFile = entry.OutputFile
+		entryOpts.batchIndex = i
+		// A queued mux runs the hook in the background, which reports
+		// straight to the result
+		results[i].Entry = entry
+		entryOpts.hook = &results[i].Hook
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-workers }()
+			if opts.batchProgress != nil {
+				opts.batchProgress.start(i)
+			}
+			err := downloadVideo(entryOpts)
+			if err != nil {
+				stopped.Store(true)
+				if parallel > 1 {
+					errorf("%s: %v", entry.URL, err)
+				} else {
+					errorf("%v", err)
+				}
+			}
+			if opts.batchProgress != nil {
+				opts.batchProgress.finish(i, err)
+			}
+			results[i].Err = err
+		}()
+	}
+	wg.Wait()
+	results = results[:attempted]
+
+	if queue != nil {
+		queue.wait()
+		for i := range results {
+			if err := queue.err(i); err != nil && results[i].Err == nil {
+				errorf("%s: %v", results[i].Entry.URL, err)
+				results[i].Err = err
+			}
+		}
+	}
+	return results
+}
+
+// muxQueue runs the work after the download of batch entries, mainly the
+// ffmpeg mux, on a bounded number of background workers
+type muxQueue struct {
+	sem  chan struct{}
+	wg   sync.WaitGroup
+	mu   sync.Mutex
+	errs map[int]error
+}
+
+func newMuxQueue(workers int) *muxQueue {
+	return &muxQueue{sem: make(chan struct{}, workers), errs: make(map[int]error)}
+}
+
+// submit runs fn for the batch entry at index in the background. It waits
+// for a free worker first, so downloads don't run ahead of the muxing and
+// fill the disk with temp files.
+func (q *muxQueue) submit(index int, fn func() error) {
+	q.sem <- struct{}{}
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+		defer func() { <-q.sem }()
+		if err := fn(); err != nil {
+			q.mu.Lock()
+			q.errs[index] = err
+			q.mu.Unlock()
+		}
+	}()
+}
+
+// failed reports whether any submitted work has failed so far
+func (q *muxQueue) failed() bool {
+	if q == nil {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.errs) > 0
+}
+
+// err returns the error of the work for the entry at index, after wait
+func (q *muxQueue) err(index int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.errs[index]
+}
+
+// wait blocks until all submitted work is done
+func (q *muxQueue) wait() {
+	q.wg.Wait()
+}
+
+// printBatchSummary prints the succeeded and failed counts, listing the
+// failures, and returns an error if any entry failed
+func printBatchSummary(results []BatchResult, total int) error {
+	var failed []BatchResult
+	for _, r := range results {
+		if r.Err != nil {
+			failed = append(failed, r)
+		}
+	}
+
+	summary := fmt.Sprintf("\nBatch complete: %d succeeded, %d failed", len(results)-len(failed), len(failed))
+	if skipped := total - len(results); skipped > 0 {
+		summary += fmt.Sprintf(", %d skipped", skipped)
+	}
+	hooks, failedHooks := 0, 0
+	for _, r := range results {
+		if r.Hook.Ran() {
+			hooks++
+		}
+		if r.Hook.Failed() {
+			failedHooks++
+		}
+	}
+	if hooks > 0 {
+		summary += fmt.Sprintf("; %d of %d hooks failed", failedHooks, hooks)
+	}
+	resultf("%s", summary)
+	for _, r := range failed {
+		if r.Hook.Ran() {
+			resultf("  FAILED %s: %v (%s)", r.Entry.URL, r.Err, r.Hook)
+		} else {
+			resultf("  FAILED %s: %v", r.Entry.URL, r.Err)
+		}
+	}
+	for _, r := range results {
+		if r.Err == nil && r.Hook.Failed() {
+			resultf("  HOOK FAILED %s: %s", r.Entry.URL, r.Hook)
+		}
+	}
+
+	if len(failed) > 0 {
+		return errors.New("some batch entries failed")
+	}
+	return nil
+}
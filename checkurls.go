@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CheckURLs requests every segment of video and audio without downloading
+// it, for -check-urls: a HEAD request, or a 1-byte GET where the server
+// rejects HEAD or the segment is a byte range. Each unreachable segment and
+// each size that differs from the playlist's is reported, and the check
+// fails if there were any.
+func (d *Downloader) CheckURLs(video, audio *Stream, baseURLPrefix string) error {
+	type result struct {
+		size int64
+		err  error
+	}
+	if d.Concurrent < 1 {
+		return errNoConcurrency
+	}
+	sem := make(chan struct{}, d.Concurrent)
+	var wg sync.WaitGroup
+	var results [2][]result
+
+	streams := [2]*Stream{VideoStream: video, AudioStream: audio}
+	for kind, stream := range streams {
+		if stream == nil {
+			continue
+		}
+		infof("Checking %d %s segment URLs...", len(stream.Segments), StreamKind(kind))
+		urls := streamSegmentURLs(stream, baseURLPrefix, stream.BaseURL, d.Query)
+		results[kind] = make([]result, len(stream.Segments))
+		for i, seg := range stream.Segments {
+			wg.Add(1)
+			go func(r *result, urlStr string, byteRange *ByteRange) {
+				defer wg.Done()
+				sem <- struct{}{}
+				defer func() { <-sem }()
+				// Taken second, as in downloadStreamSegments
+				if d.Slots != nil {
+					d.Slots <- struct{}{}
+					defer func() { <-d.Slots }()
+				}
+
+				for attempt := 0; attempt <= d.MaxRetries; attempt++ {
+					if attempt > 0 {
+						d.Metrics.retry()
+						time.Sleep(retryDelay(attempt))
+					}
+					r.size, r.err = d.checkSegment(urlStr, byteRange)
+					if r.err == nil || !isTransient(r.err) {
+						break
+					}
+				}
+			}(&results[kind][i], urls[i], seg.Range)
+		}
+	}
+	wg.Wait()
+
+	// Reported in order once all are done, the checks finish in any order
+	checked, bad, unknown := 0, 0, 0
+	for kind, stream := range streams {
+		for i, r := range results[kind] {
+			checked++
+			expected := stream.Segments[i].Size
+			switch {
+			case r.err != nil:
+				errorf("%s segment %d: %v", StreamKind(kind), i, r.err)
+				bad++
+			case r.size < 0 || expected == 0:
+				unknown++
+			case r.size != int64(expected):
+				errorf("%s segment %d: %d bytes, the playlist says %d", StreamKind(kind), i, r.size, expected)
+				bad++
+			}
+		}
+	}
+
+	if bad > 0 {
+		return fmt.Errorf("%d of %d segments failed the check", bad, checked)
+	}
+	if unknown > 0 {
+		resultf("All %d segments are reachable, %d of unknown size", checked, unknown)
+		return nil
+	}
+	resultf("All %d segments are reachable and match the playlist's sizes", checked)
+	return nil
+}
+
+// checkSegment requests urlStr without downloading it and returns its size,
+// or -1 when the server doesn't say. For a byte range, the range is checked
+// to lie within the file and its length is returned.
+func (d *Downloader) checkSegment(urlStr string, byteRange *ByteRange) (int64, error) {
+	if byteRange == nil {
+		resp, err := d.checkRequest("HEAD", urlStr, "")
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode == http.StatusOK:
+			return resp.ContentLength, nil
+		case resp.StatusCode != http.StatusMethodNotAllowed && resp.StatusCode != http.StatusNotImplemented:
+			return 0, newHTTPError(resp, urlStr)
+		}
+		// HEAD isn't allowed, ask for the first byte instead
+	}
+
+	first := int64(0)
+	if byteRange != nil {
+		first = byteRange.Start
+	}
+	resp, err := d.checkRequest("GET", urlStr, fmt.Sprintf("bytes=%d-%d", first, first))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	total := int64(-1)
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		// Content-Range: bytes 0-0/12345, where the total may be *
+		_, length, _ := strings.Cut(resp.Header.Get("Content-Range"), "/")
+		if n, err := strconv.ParseInt(length, 10, 64); err == nil {
+			total = n
+		}
+	case http.StatusOK:
+		// The server ignored Range and sends the whole segment
+		total = resp.ContentLength
+	default:
+		return 0, newHTTPError(resp, urlStr)
+	}
+	// Only the first byte was asked for, don't read on when it's ignored
+	io.CopyN(io.Discard, resp.Body, 1)
+
+	if byteRange == nil {
+		return total, nil
+	}
+	if total >= 0 && total <= byteRange.End {
+		return 0, fmt.Errorf("range %d-%d beyond the %d byte file", byteRange.Start, byteRange.End, total)
+	}
+	return byteRange.Len(), nil
+}
+
+// checkRequest sends a bodiless request for checkSegment
+func (d *Downloader) checkRequest(method, urlStr, byteRange string) (*http.Response, error) {
+	req, err := http.NewRequest(method, urlStr, nil)
+	if err != nil {
+		return nil, err
+	}
+	d.setHeaders(req)
+	if byteRange != "" {
+		req.Header.Set("Range", byteRange)
+	}
+
+	start := time.Now()
+	resp, err := d.client().Do(req)
+	if err != nil {
+		return nil, redactURLError(err)
+	}
+	logger.Debug(method, "url", redactURL(urlStr), "range", byteRange, "status", resp.StatusCode, "bytes", resp.ContentLength, "duration", time.Since(start))
+	return resp, nil
+}
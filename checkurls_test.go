@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCheckURLs(t *testing.T) {
+	srv := httptest.NewServer(segmentHandler(nil))
+	defer srv.Close()
+	d := &Downloader{Concurrent: 2}
+
+	video, audio := testStream("v", 4), testStream("a", 3)
+	if err := d.CheckURLs(&video, &audio, srv.URL+"/"); err != nil {
+		t.Errorf("matching sizes: %v", err)
+	}
+
+	// The playlist says one segment is larger than what the server has
+	video.Segments[2].Size += 3
+	err := d.CheckURLs(&video, &audio, srv.URL+"/")
+	if err == nil || !strings.Contains(err.Error(), "1 of 7 segments failed") {
+		t.Errorf("mismatched Content-Length: %v, want 1 of 7 segments failed", err)
+	}
+
+	// Sizes the playlist doesn't have can't mismatch
+	video = testStream("v", 4)
+	video.Segments[1].Size = 0
+	if err := d.CheckURLs(&video, nil, srv.URL+"/"); err != nil {
+		t.Errorf("unknown size: %v", err)
+	}
+
+	missing := testStream("gone", 2)
+	missing.Segments[1].URL = "nope.m4s"
+	if err := d.CheckURLs(&missing, nil, srv.URL+"/"); err == nil || !strings.Contains(err.Error(), "1 of 2") {
+		t.Errorf("unreachable segment: %v, want 1 of 2 segments failed", err)
+	}
+}
+
+func TestCheckURLsWithoutHEAD(t *testing.T) {
+	var methods []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		if r.Method == "HEAD" {
+			http.Error(w, "no HEAD", http.StatusMethodNotAllowed)
+			return
+		}
+		segmentHandler(nil).ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	// The server ignores the Range of the GET, its Content-Length counts
+	stream := testStream("v", 1)
+	d := &Downloader{Concurrent: 1}
+	if err := d.CheckURLs(&stream, nil, srv.URL+"/"); err != nil {
+		t.Errorf("matching size: %v", err)
+	}
+	stream.Segments[0].Size++
+	if err := d.CheckURLs(&stream, nil, srv.URL+"/"); err == nil {
+		t.Error("mismatched size after a rejected HEAD passed")
+	}
+	if strings.Join(methods, " ") != "HEAD GET HEAD GET" {
+		t.Errorf("requests %v, want a GET after each rejected HEAD", methods)
+	}
+}
+
+func TestCheckURLsByteRanges(t *testing.T) {
+	stream, media := rangeStream(4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "media.mp4", time.Time{}, strings.NewReader(string(media)))
+	}))
+	defer srv.Close()
+
+	d := &Downloader{Concurrent: 2}
+	if err := d.CheckURLs(&stream, nil, srv.URL+"/"); err != nil {
+		t.Errorf("ranges within the file: %v", err)
+	}
+	stream.Segments[3].Range = &ByteRange{Start: 30, End: int64(len(media))}
+	if err := d.CheckURLs(&stream, nil, srv.URL+"/"); err == nil {
+		t.Error("a range past the end of the file passed")
+	}
+}
+
+func TestCheckURLsNoConcurrency(t *testing.T) {
+	stream := testStream("v", 1)
+	if err := (&Downloader{}).CheckURLs(&stream, nil, "http://video.test/"); err != errNoConcurrency {
+		t.Errorf("CheckURLs = %v, want errNoConcurrency", err)
+	}
+}
+
+func TestCheckURLsSharedSlots(t *testing.T) {
+	var current, highest atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := current.Add(1)
+		defer current.Add(-1)
+		for {
+			h := highest.Load()
+			if n <= h || highest.CompareAndSwap(h, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		segmentHandler(nil).ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	// The batch's slots bound the check below the Downloader's own -c
+	d := &Downloader{Concurrent: 4, Slots: make(chan struct{}, 1)}
+	video, audio := testStream("v", 4), testStream("a", 3)
+	if err := d.CheckURLs(&video, &audio, srv.URL+"/"); err != nil {
+		t.Fatal(err)
+	}
+	if got := highest.Load(); got != 1 {
+		t.Errorf("%d requests at once, want 1 with one shared slot", got)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// defaultConfigFile is where defaults for the flags are read from when
+// -config isn't given, "" if there is no user config directory
+func defaultConfigFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "vimeo-downloader", "config.json")
+}
+
+// applyConfigFile sets the flags of fs that weren't given on the command
+// line from the JSON object in path, keyed by flag name:
+//
+//	{"c": 32, "user-agent": "...", "y": true}
+//
+// Values go through the flags' own parsing, so they end up in Options just
+// like command-line values. A missing file is only an error if required.
+func applyConfigFile(fs *flag.FlagSet, path string, required bool) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !required {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+
+	var values map[string]any
+	dec := json.NewDecoder(bytes.NewReader(data))
+	// Keep numbers as written, 16 and not 1.6e+01
+	dec.UseNumber()
+	if err := dec.Decode(&values); err != nil {
+		return fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+
+	// Keyed by the flag's Value, so an alias like -v for -verbose, bound to
+	// the same variable, counts as given too
+	given := make(map[flag.Value]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Value] = true })
+
+	// Sorted so the first bad key reported is always the same
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == "config" || fs.Lookup(name) == nil {
+			return fmt.Errorf("config file %s: unknown option %q", path, name)
+		}
+		if given[fs.Lookup(name).Value] {
+			continue
+		}
+		var value string
+		switch v := values[name].(type) {
+		case string:
+			value = v
+		case json.Number:
+			value = v.String()
+		case bool:
+			value = fmt.Sprint(v)
+		default:
+			return fmt.Errorf("config file %s: %q must be a string, number, or boolean", path, name)
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("config file %s: %s: %w", path, name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestApplyConfigFileAliases(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		args   []string
+		want   bool
+	}{
+		{"config only", `{"verbose": true}`, nil, true},
+		{"same name on the command line", `{"verbose": true}`, []string{"-verbose=false"}, false},
+		{"alias on the command line", `{"verbose": true}`, []string{"-v=false"}, false},
+		{"long alias on the command line", `{"v": true}`, []string{"-verbose=false"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var verbose bool
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.BoolVar(&verbose, "v", false, "")
+			fs.BoolVar(&verbose, "verbose", false, "")
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			if err := applyConfigFile(fs, writeConfig(t, tt.config), true); err != nil {
+				t.Fatal(err)
+			}
+			if verbose != tt.want {
+				t.Errorf("verbose = %v, want %v", verbose, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+	}{
+		{"unknown option", `{"nope": 1}`},
+		{"config itself", `{"config": "other.json"}`},
+		{"bad type", `{"c": [1]}`},
+		{"bad value", `{"c": "many"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.Int("c", 1, "")
+			fs.String("config", "", "")
+			if err := applyConfigFile(fs, writeConfig(t, tt.config), true); err == nil {
+				t.Error("applyConfigFile succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestApplyConfigFileMissing(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	missing := filepath.Join(t.TempDir(), "config.json")
+	if err := applyConfigFile(fs, missing, false); err != nil {
+		t.Errorf("optional missing file: %v", err)
+	}
+	if err := applyConfigFile(fs, missing, true); err == nil {
+		t.Error("required missing file succeeded, want an error")
+	}
+}
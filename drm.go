@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrDRMProtected is returned for content that is encrypted with DRM,
+// whose segments would only mux into an unplayable file
+var ErrDRMProtected = errors.New("content is DRM-protected and cannot be downloaded")
+
+// encryptionBoxes are MP4 box types that only appear in encrypted (CENC)
+// init segments: pssh with a DRM system's data, the encv and enca sample
+// entries of encrypted tracks, and the sinf describing their encryption
+var encryptionBoxes = map[string]bool{"pssh": true, "sinf": true, "encv": true, "enca": true}
+
+// parsePlaylist parses playlist JSON into playlist, rejecting DRM-protected
+// content before any segment is downloaded
+func parsePlaylist(data []byte, playlist *Playlist) error {
+	// An HLS playlist is never valid JSON, but say why when it's encrypted
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("#EXTM3U")) && hlsEncrypted(data) {
+		return fmt.Errorf("%w (HLS playlist uses SAMPLE-AES encryption)", ErrDRMProtected)
+	}
+
+	if err := json.Unmarshal(data, playlist); err != nil {
+		return fmt.Errorf("parsing playlist JSON: %w", err)
+	}
+	return detectDRM(playlist)
+}
+
+// detectDRM looks for content protection metadata in the playlist and for
+// encryption boxes in the streams' init segments
+func detectDRM(playlist *Playlist) error {
+	if hasJSONValue(playlist.ContentProtection) {
+		return fmt.Errorf("%w (playlist has content_protection)", ErrDRMProtected)
+	}
+
+	for _, streams := range [][]Stream{playlist.Video, playlist.Audio} {
+		for i := range streams {
+			s := &streams[i]
+			if hasJSONValue(s.ContentProtection) {
+				return fmt.Errorf("%w (stream %s has content_protection)", ErrDRMProtected, s.ID)
+			}
+			init, err := base64.StdEncoding.DecodeString(s.InitSegment)
+			if err != nil {
+				continue
+			}
+			// An init segment that doesn't parse is reported by
+			// checkStreamInit once the stream is selected
+			if box, _ := findEncryptionBox(init, 0, false); box != "" {
+				return fmt.Errorf("%w (stream %s init segment has a %s box)", ErrDRMProtected, s.ID, box)
+			}
+		}
+	}
+	return nil
+}
+
+// findEncryptionBox walks the box tree of an init segment from moov down to
+// the sample entries, and returns the type of the first encryption box on
+// the way, or "" if there is none. In data holding sample entries, each
+// entry's children start entryHeader bytes into its body, after the fixed
+// fields of its handler's entry type.
+func findEncryptionBox(data []byte, entryHeader int, sampleEntries bool) (string, error) {
+	boxes, err := readBoxes(data)
+	if err != nil {
+		return "", err
+	}
+	for _, box := range boxes {
+		if encryptionBoxes[box.typ] {
+			return box.typ, nil
+		}
+		var found string
+		switch {
+		case sampleEntries:
+			if entryHeader == 0 || len(box.body) < entryHeader {
+				continue
+			}
+			found, err = findEncryptionBox(box.body[entryHeader:], 0, false)
+		case box.typ == "moov" || box.typ == "trak" || box.typ == "minf" || box.typ == "stbl":
+			found, err = findEncryptionBox(box.body, entryHeader, false)
+		case box.typ == "mdia":
+			found, err = findEncryptionBox(box.body, sampleEntryHeader(box.body), false)
+		case box.typ == "stsd":
+			// A full box with an entry count before the sample entries
+			if len(box.body) < 8 {
+				return "", fmt.Errorf("truncated stsd box")
+			}
+			found, err = findEncryptionBox(box.body[8:], entryHeader, true)
+		}
+		if found != "" || err != nil {
+			return found, err
+		}
+	}
+	return "", nil
+}
+
+// sampleEntryHeader returns the size of the fixed fields of the sample
+// entries in an mdia box, from its handler type, or 0 when it isn't a video
+// or audio track
+func sampleEntryHeader(mdia []byte) int {
+	boxes, err := readBoxes(mdia)
+	if err != nil {
+		return 0
+	}
+	hdlr := findBox(boxes, "hdlr")
+	if hdlr == nil || len(hdlr.body) < 12 {
+		return 0
+	}
+	switch string(hdlr.body[8:12]) {
+	case "vide":
+		return 78
+	case "soun":
+		return 28
+	}
+	return 0
+}
+
+// hlsEncrypted reports whether an HLS playlist has an #EXT-X-KEY with
+// SAMPLE-AES, the method used by FairPlay and other DRM schemes
+func hlsEncrypted(data []byte) bool {
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if bytes.HasPrefix(line, []byte("#EXT-X-KEY")) || bytes.HasPrefix(line, []byte("#EXT-X-SESSION-KEY")) {
+			if bytes.Contains(line, []byte("METHOD=SAMPLE-AES")) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasJSONValue reports whether raw holds something other than null or an
+// empty object, array or string
+func hasJSONValue(raw json.RawMessage) bool {
+	switch string(bytes.TrimSpace(raw)) {
+	case "", "null", "{}", "[]", `""`, "false":
+		return false
+	}
+	return true
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// testBox returns an MP4 box of type typ holding body
+func testBox(typ string, body ...[]byte) []byte {
+	var content []byte
+	for _, b := range body {
+		content = append(content, b...)
+	}
+	box := binary.BigEndian.AppendUint32(nil, uint32(8+len(content)))
+	return append(append(box, typ...), content...)
+}
+
+// testHeaderBox is an mvhd or mdhd box of version 0 with a timescale
+func testHeaderBox(typ string, timescale uint32) []byte {
+	body := make([]byte, 24)
+	binary.BigEndian.PutUint32(body[12:], timescale)
+	return testBox(typ, body)
+}
+
+// testInitSegment is an init segment with one track of handler (vide or
+// soun) described by a sample entry of type entry, whose children follow
+// the entry's fixed fields. Extra boxes go into moov.
+func testInitSegment(handler, entry string, entryChildren []byte, moovExtra ...[]byte) []byte {
+	headerSize := 78
+	if handler == "soun" {
+		headerSize = 28
+	}
+	hdlr := append(make([]byte, 8), handler...)
+	hdlr = append(hdlr, make([]byte, 13)...)
+	stsd := testBox("stsd", []byte{0, 0, 0, 0, 0, 0, 0, 1}, testBox(entry, make([]byte, headerSize), entryChildren))
+	trak := testBox("trak", testBox("mdia",
+		testHeaderBox("mdhd", 90000),
+		testBox("hdlr", hdlr),
+		testBox("minf", testBox("stbl", stsd)),
+	))
+	moov := append([][]byte{testHeaderBox("mvhd", 1000), trak}, moovExtra...)
+	return append(testBox("ftyp", []byte("isom\x00\x00\x02\x00")), testBox("moov", moov...)...)
+}
+
+func TestFindEncryptionBox(t *testing.T) {
+	// An avcC whose payload happens to spell box names isn't encryption
+	avcC := testBox("avcC", []byte("pssh sinf encv"))
+	sinf := testBox("sinf", testBox("frma", []byte("avc1")), testBox("schm", make([]byte, 12)))
+	tests := []struct {
+		name string
+		init []byte
+		want string
+	}{
+		{"clear video", testInitSegment("vide", "avc1", avcC), ""},
+		{"clear audio", testInitSegment("soun", "mp4a", testBox("esds", make([]byte, 20))), ""},
+		{"pssh", testInitSegment("vide", "avc1", avcC, testBox("pssh", make([]byte, 32))), "pssh"},
+		{"encv", testInitSegment("vide", "encv", append(avcC, sinf...)), "encv"},
+		{"enca", testInitSegment("soun", "enca", sinf), "enca"},
+		{"sinf in a clear entry", testInitSegment("vide", "avc1", append(avcC, sinf...)), "sinf"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := findEncryptionBox(tt.init, 0, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("findEncryptionBox = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePlaylistDRM(t *testing.T) {
+	encrypted := base64.StdEncoding.EncodeToString(testInitSegment("vide", "encv", nil))
+	clear := base64.StdEncoding.EncodeToString(testInitSegment("vide", "avc1", testBox("avcC", []byte("pssh"))))
+	tests := []struct {
+		name     string
+		playlist string
+		drm      bool
+	}{
+		{"clear", `{"clip_id": "1", "video": [{"id": "v", "init_segment": "` + clear + `"}]}`, false},
+		{"empty content_protection", `{"clip_id": "1", "content_protection": {}, "video": [{"id": "v", "content_protection": null}]}`, false},
+		{"playlist content_protection", `{"clip_id": "1", "content_protection": {"widevine": {"license_url": "https://example.com"}}}`, true},
+		{"stream content_protection", `{"clip_id": "1", "audio": [{"id": "a", "content_protection": ["cenc"]}]}`, true},
+		{"encrypted init segment", `{"clip_id": "1", "video": [{"id": "v", "init_segment": "` + encrypted + `"}]}`, true},
+		{"HLS SAMPLE-AES", "#EXTM3U\n#EXT-X-KEY:METHOD=SAMPLE-AES,URI=\"skd://key\"\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var playlist Playlist
+			err := parsePlaylist([]byte(tt.playlist), &playlist)
+			if got := errors.Is(err, ErrDRMProtected); got != tt.drm {
+				t.Errorf("parsePlaylist: %v, want DRM %v", err, tt.drm)
+			}
+			if !tt.drm && err != nil {
+				t.Errorf("parsePlaylist: %v", err)
+			}
+		})
+	}
+}
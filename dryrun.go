@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// DryRunPlan is what a download would do, printed by -dry-run
+type DryRunPlan struct {
+	Video         *Stream
+	Audio         *Stream
+	EstimatedSize int64
+	Container     Container
+	Outputs       []string
+	Overwrite     bool     // -y was given
+	FFmpegArgs    []string // nil when no muxing is needed
+}
+
+// dryRunPlan builds the plan of downloadFromPlaylist from its decisions.
+// The ffmpeg command is the one muxStreams would run, with placeholders for
+// the temp directory, which isn't created.
+func dryRunPlan(opts Options, src *playlistSource, video, audio *Stream, estimatedSize int64, container Container, outputs []string, metadata Metadata, thumbnailURL string, trim *TimeRange) *DryRunPlan {
+	plan := &DryRunPlan{
+		Video:         video,
+		Audio:         audio,
+		EstimatedSize: estimatedSize,
+		Container:     container,
+		Outputs:       outputs,
+		Overwrite:     opts.Overwrite,
+	}
+	if opts.SkipMux || video == nil || audio == nil {
+		return plan
+	}
+
+	tempBase := opts.TempDir
+	if tempBase == "" {
+		tempBase = os.TempDir()
+	}
+	tempDir := filepath.Join(tempBase, "vimeo-download-XXXXXX")
+	muxOpts := MuxOptions{Container: container, Metadata: metadata, Trim: trim, FastStart: opts.FastStart}
+	if thumbnailURL != "" && container.CoverArt {
+		muxOpts.Thumbnail = filepath.Join(tempDir, "thumbnail.jpg")
+	}
+	if opts.Subs || opts.SubsLang != "" {
+		for i, t := range selectTextTracks(textTracks(src.config), opts.SubsLang) {
+			muxOpts.Subtitles = append(muxOpts.Subtitles, SubtitleFile{
+				Path:  filepath.Join(tempDir, fmt.Sprintf("subtitles_%d.srt", i)),
+				Lang:  t.Lang,
+				Label: t.Label,
+			})
+		}
+	}
+	output := opts.OutputFile
+	if isRemoteOutput(output) {
+		output = filepath.Join(tempDir, "output"+filepath.Ext(output))
+	}
+	plan.FFmpegArgs = muxArgs(filepath.Join(tempDir, "video.mp4"), filepath.Join(tempDir, "audio.mp4"), output, muxOpts)
+	return plan
+}
+
+// printDryRun checks that the plan could run, whether ffmpeg is installed
+// and the outputs can be written, then prints it
+func printDryRun(plan *DryRunPlan) error {
+	if plan.FFmpegArgs != nil {
+		if _, err := exec.LookPath("ffmpeg"); err != nil {
+			return fmt.Errorf("ffmpeg is needed to mux the streams: %w", err)
+		}
+	}
+	for _, output := range plan.Outputs {
+		if isRemoteOutput(output) {
+			continue
+		}
+		if err := checkWritable(output); err != nil {
+			return fmt.Errorf("output %s is not writable: %w", output, err)
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "\nDry run, nothing was downloaded:\n")
+	if plan.Video != nil {
+		fmt.Fprintf(&b, "  Video:   %dx%d @ %d kbps, %s, %d segments\n",
+			plan.Video.Width, plan.Video.Height, plan.Video.Bitrate/1000, plan.Video.Codecs, len(plan.Video.Segments))
+	}
+	if plan.Audio != nil {
+		fmt.Fprintf(&b, "  Audio:   %d kbps, %s, %d segments\n",
+			plan.Audio.Bitrate/1000, plan.Audio.Codecs, len(plan.Audio.Segments))
+	}
+	size := "unknown"
+	if plan.EstimatedSize > 0 {
+		size = formatSize(plan.EstimatedSize)
+	}
+	fmt.Fprintf(&b, "  Size:    %s (estimated)\n", size)
+	if len(plan.Outputs) == 0 {
+		fmt.Fprintf(&b, "  Output:  stdout (%s)\n", plan.Container.Name)
+	}
+	for _, output := range plan.Outputs {
+		note := ""
+		if isRemoteOutput(output) {
+			note = ", uploaded after muxing"
+		} else if _, err := os.Stat(output); err == nil {
+			note = ", exists and will be overwritten"
+			if !plan.Overwrite {
+				note = ", exists, asks before overwriting"
+			}
+		}
+		fmt.Fprintf(&b, "  Output:  %s (%s%s)\n", output, plan.Container.Name, note)
+	}
+	if plan.FFmpegArgs != nil {
+		fmt.Fprintf(&b, "  Command: %s", shellJoin(append([]string{"ffmpeg"}, plan.FFmpegArgs...)))
+	} else {
+		fmt.Fprintf(&b, "  Command: none, ffmpeg isn't needed")
+	}
+	resultf("%s", b.String())
+	return nil
+}
+
+// checkWritable reports whether path can be written without writing it. A
+// missing file is checked by creating and removing a file in the nearest
+// directory above it that exists, as the ones in between would be created.
+func checkWritable(path string) error {
+	info, err := os.Stat(path)
+	if err == nil {
+		if info.IsDir() {
+			return errors.New("is a directory")
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		return f.Close()
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	dir := filepath.Dir(path)
+	for {
+		info, err := os.Stat(dir)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("%s is not a directory", dir)
+			}
+			break
+		}
+		parent := filepath.Dir(dir)
+		if !errors.Is(err, os.ErrNotExist) || parent == dir {
+			return err
+		}
+		dir = parent
+	}
+	f, err := os.CreateTemp(dir, ".vimeo-downloader-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// shellJoin quotes args for the shell, so the printed command can be
+// pasted
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckWritable(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "existing.mp4")
+	if err := os.WriteFile(existing, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		path string
+		ok   bool
+	}{
+		{"missing file", filepath.Join(dir, "out.mp4"), true},
+		{"existing file", existing, true},
+		{"directories to create", filepath.Join(dir, "a", "b", "out.mp4"), true},
+		{"directory", dir, false},
+		{"under a file", filepath.Join(existing, "out.mp4"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkWritable(tt.path); (err == nil) != tt.ok {
+				t.Errorf("checkWritable(%q) = %v, want ok %v", tt.path, err, tt.ok)
+			}
+		})
+	}
+	// Nothing is left behind, not even the directories
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("checkWritable left %v", entries)
+	}
+}
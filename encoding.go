@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// readBody reads the body of resp, decoding it according to its
+// Content-Encoding. Go only decompresses transparently when it added the
+// Accept-Encoding header itself, so a caller-supplied one would otherwise
+// hand back compressed bytes.
+func readBody(resp *http.Response) ([]byte, error) {
+	body, err := decodeBody(resp.Body, resp.Header.Get("Content-Encoding"))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+// decodeBody wraps r in decoders for the comma-separated encodings, which
+// are listed in the order they were applied
+func decodeBody(r io.Reader, encoding string) (io.ReadCloser, error) {
+	rc := io.NopCloser(r)
+	codings := strings.Split(encoding, ",")
+	for i := len(codings) - 1; i >= 0; i-- {
+		var err error
+		switch coding := strings.ToLower(strings.TrimSpace(codings[i])); coding {
+		case "", "identity":
+		case "gzip", "x-gzip":
+			rc, err = gzip.NewReader(rc)
+		case "deflate":
+			rc, err = newDeflateReader(rc)
+		default:
+			// Brotli and zstd would need a dependency, and aren't
+			// requested unless a header override asks for them
+			return nil, fmt.Errorf("unsupported Content-Encoding %q", coding)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("decoding %s response: %w", codings[i], err)
+		}
+	}
+	return rc, nil
+}
+
+// newDeflateReader decodes "deflate", which is meant to be zlib-wrapped but
+// is sent as a raw deflate stream by some servers
+func newDeflateReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+	// A zlib header has compression method 8 and is a multiple of 31
+	if header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
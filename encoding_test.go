@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func gzipped(t *testing.T, data string) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	w.Write([]byte(data))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestFetchGzipJSON(t *testing.T) {
+	const playlist = `{"clip_id": "gz", "base_url": "../"}`
+	body := gzipped(t, playlist)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(body)
+	}))
+	defer srv.Close()
+
+	// Asking for gzip ourselves turns off Go's transparent decoding
+	d := &Downloader{Concurrent: 1, Headers: map[string]string{"Accept-Encoding": "gzip, deflate"}}
+	data, err := d.fetchURL(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p Playlist
+	if err := json.Unmarshal(data, &p); err != nil {
+		t.Fatalf("fetched %q isn't JSON: %v", data, err)
+	}
+	if p.ClipID != "gz" {
+		t.Errorf("clip_id %q, want gz", p.ClipID)
+	}
+}
+
+func TestDecodeBody(t *testing.T) {
+	const want = "some playlist JSON, repeated a little: some playlist JSON"
+	var zlibData, rawDeflate bytes.Buffer
+	zw := zlib.NewWriter(&zlibData)
+	zw.Write([]byte(want))
+	zw.Close()
+	fw, _ := flate.NewWriter(&rawDeflate, flate.DefaultCompression)
+	fw.Write([]byte(want))
+	fw.Close()
+
+	// gzip applied over a zlib stream
+	var stacked bytes.Buffer
+	gw := gzip.NewWriter(&stacked)
+	gw.Write(zlibData.Bytes())
+	gw.Close()
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+	}{
+		{"identity", "", []byte(want)},
+		{"gzip", "gzip", gzipped(t, want)},
+		{"x-gzip", "X-Gzip", gzipped(t, want)},
+		{"zlib deflate", "deflate", zlibData.Bytes()},
+		{"raw deflate", "deflate", rawDeflate.Bytes()},
+		{"stacked", "deflate, gzip", stacked.Bytes()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc, err := decodeBody(bytes.NewReader(tt.body), tt.encoding)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(rc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != want {
+				t.Errorf("decoded %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestDecodeBodyUnsupported(t *testing.T) {
+	if _, err := decodeBody(strings.NewReader("x"), "br"); err == nil {
+		t.Error("brotli accepted")
+	}
+	if _, err := decodeBody(strings.NewReader("not gzip"), "gzip"); err == nil {
+		t.Error("a corrupt gzip body accepted")
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxFilenameBytes keeps generated names well under the 255 byte limit of
+// common filesystems, leaving room for an extension
+const maxFilenameBytes = 200
+
+// windowsReserved are device names Windows refuses as file names
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// sanitizeFilename turns name into a file name that is valid on Linux,
+// macOS and Windows. Characters those systems reject are replaced with "_",
+// whitespace runs are collapsed, and trailing dots and spaces (which Windows
+// strips) are removed. Unicode letters are kept. The result is "" when
+// nothing usable remains.
+func sanitizeFilename(name string) string {
+	var b strings.Builder
+	lastSpace := false
+	for _, r := range name {
+		switch {
+		// Tabs and newlines are control characters too, but a title's
+		// line breaks are better kept as spaces
+		case unicode.IsSpace(r):
+			if !lastSpace {
+				b.WriteRune(' ')
+			}
+			lastSpace = true
+		case strings.ContainsRune(`/\:*?"<>|`, r) || unicode.IsControl(r):
+			b.WriteRune('_')
+			lastSpace = false
+		case r == utf8.RuneError:
+			// Drop invalid UTF-8
+		default:
+			b.WriteRune(r)
+			lastSpace = false
+		}
+	}
+
+	s := strings.TrimSpace(b.String())
+	s = truncateUTF8(s, maxFilenameBytes)
+	s = strings.TrimRight(s, ". ")
+
+	base := s
+	if i := strings.IndexByte(base, '.'); i >= 0 {
+		base = base[:i]
+	}
+	if windowsReserved[strings.ToUpper(base)] {
+		s = "_" + s
+	}
+	return s
+}
+
+// truncateUTF8 shortens s to at most n bytes without splitting a rune
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// defaultOutputBase derives an output file name, without extension, from
+// the video title or clip ID, falling back to "output"
+func defaultOutputBase(title, clipID string) string {
+	if name := sanitizeFilename(title); name != "" {
+		return name
+	}
+	if name := sanitizeFilename(clipID); name != "" {
+		return "clip_" + name
+	}
+	return "output"
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "My Talk", "My Talk"},
+		{"slashes", "a/b\\c", "a_b_c"},
+		{"colons", "Part 1: Intro", "Part 1_ Intro"},
+		{"other reserved", `what?*"<>|`, "what______"},
+		{"control characters", "tab\there\x00", "tab here_"},
+		{"whitespace runs", "  lots   of\n\nspace  ", "lots of space"},
+		{"unicode", "Café – 東京 🎬", "Café – 東京 🎬"},
+		{"invalid UTF-8", "bad\xffname", "badname"},
+		{"trailing dots", "The End...", "The End"},
+		{"trailing dots and spaces", "end . . ", "end"},
+		{"reserved name", "CON", "_CON"},
+		{"reserved name in lower case", "nul", "_nul"},
+		{"reserved name with an extension", "com1.txt", "_com1.txt"},
+		{"reserved prefix only", "CONSOLE", "CONSOLE"},
+		{"nothing left", "...", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeFilename(tt.in); got != tt.want {
+				t.Errorf("sanitizeFilename(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeFilenameLength(t *testing.T) {
+	got := sanitizeFilename(strings.Repeat("東", 100))
+	if len(got) > maxFilenameBytes || !utf8.ValidString(got) {
+		t.Errorf("long name truncated to %d bytes, valid UTF-8 %v", len(got), utf8.ValidString(got))
+	}
+}
+
+func TestDefaultOutputBase(t *testing.T) {
+	tests := []struct {
+		title, clipID, want string
+	}{
+		{"A: Title", "123", "A_ Title"},
+		{"", "123", "clip_123"},
+		{"...", "", "output"},
+	}
+	for _, tt := range tests {
+		if got := defaultOutputBase(tt.title, tt.clipID); got != tt.want {
+			t.Errorf("defaultOutputBase(%q, %q) = %q, want %q", tt.title, tt.clipID, got, tt.want)
+		}
+	}
+}
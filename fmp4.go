@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// mp4Box is one box (atom) of an MP4 file
+type mp4Box struct {
+	typ  string
+	body []byte
+}
+
+// readBoxes splits data into the boxes it consists of, failing on a box
+// that runs past the end of data
+func readBoxes(data []byte) ([]mp4Box, error) {
+	var boxes []mp4Box
+	for offset := 0; offset < len(data); {
+		rest := data[offset:]
+		if len(rest) < 8 {
+			return nil, fmt.Errorf("truncated box header at offset %d", offset)
+		}
+		size, header := uint64(binary.BigEndian.Uint32(rest)), uint64(8)
+		typ := string(rest[4:8])
+		switch size {
+		case 0: // The box runs to the end
+			size = uint64(len(rest))
+		case 1: // A 64-bit size follows the type
+			if len(rest) < 16 {
+				return nil, fmt.Errorf("truncated %s box header at offset %d", typ, offset)
+			}
+			size, header = binary.BigEndian.Uint64(rest[8:]), 16
+		}
+		if size < header || size > uint64(len(rest)) {
+			return nil, fmt.Errorf("%s box at offset %d is %d bytes, but %d are left", typ, offset, size, len(rest))
+		}
+		boxes = append(boxes, mp4Box{typ: typ, body: rest[header:size]})
+		offset += int(size)
+	}
+	return boxes, nil
+}
+
+// findBox returns the first box of type typ, or nil
+func findBox(boxes []mp4Box, typ string) *mp4Box {
+	for i := range boxes {
+		if boxes[i].typ == typ {
+			return &boxes[i]
+		}
+	}
+	return nil
+}
+
+// headerTimescale reads the timescale of a full box laid out like mvhd and
+// mdhd: version and flags, then creation and modification times that are
+// 64-bit in version 1
+func headerTimescale(box *mp4Box) (uint32, error) {
+	offset := 12
+	if len(box.body) > 0 && box.body[0] == 1 {
+		offset = 20
+	}
+	if len(box.body) < offset+4 {
+		return 0, fmt.Errorf("truncated %s box", box.typ)
+	}
+	timescale := binary.BigEndian.Uint32(box.body[offset:])
+	if timescale == 0 {
+		return 0, fmt.Errorf("%s box has a timescale of 0", box.typ)
+	}
+	return timescale, nil
+}
+
+// checkInitSegment checks that data is a fragmented MP4 init segment that
+// ffmpeg can use: an ftyp and a moov box with a timescale and a track of
+// the given kind, each track with its own timescale
+func checkInitSegment(data []byte, kind StreamKind) error {
+	boxes, err := readBoxes(data)
+	if err != nil {
+		return err
+	}
+	if findBox(boxes, "ftyp") == nil {
+		return fmt.Errorf("no ftyp box, this isn't an MP4 init segment")
+	}
+	moov := findBox(boxes, "moov")
+	if moov == nil {
+		return fmt.Errorf("no moov box")
+	}
+	moovBoxes, err := readBoxes(moov.body)
+	if err != nil {
+		return fmt.Errorf("moov: %w", err)
+	}
+	mvhd := findBox(moovBoxes, "mvhd")
+	if mvhd == nil {
+		return fmt.Errorf("moov has no mvhd box")
+	}
+	if _, err := headerTimescale(mvhd); err != nil {
+		return err
+	}
+
+	want := "vide"
+	if kind == AudioStream {
+		want = "soun"
+	}
+	var handlers []string
+	for _, trak := range moovBoxes {
+		if trak.typ != "trak" {
+			continue
+		}
+		handler, err := checkTrack(trak.body)
+		if err != nil {
+			return fmt.Errorf("track %d: %w", len(handlers)+1, err)
+		}
+		if handler == want {
+			return nil
+		}
+		handlers = append(handlers, handler)
+	}
+	if len(handlers) == 0 {
+		return fmt.Errorf("moov has no tracks")
+	}
+	return fmt.Errorf("no %s track, only %s (is it the init segment of another stream?)", kind, strings.Join(handlers, ", "))
+}
+
+// checkTrack checks the mdia box of a trak and returns its handler type,
+// e.g. vide or soun
+func checkTrack(trak []byte) (string, error) {
+	boxes, err := readBoxes(trak)
+	if err != nil {
+		return "", err
+	}
+	mdia := findBox(boxes, "mdia")
+	if mdia == nil {
+		return "", fmt.Errorf("no mdia box")
+	}
+	mdiaBoxes, err := readBoxes(mdia.body)
+	if err != nil {
+		return "", fmt.Errorf("mdia: %w", err)
+	}
+	mdhd := findBox(mdiaBoxes, "mdhd")
+	if mdhd == nil {
+		return "", fmt.Errorf("mdia has no mdhd box")
+	}
+	if _, err := headerTimescale(mdhd); err != nil {
+		return "", err
+	}
+	hdlr := findBox(mdiaBoxes, "hdlr")
+	if hdlr == nil || len(hdlr.body) < 12 {
+		return "", fmt.Errorf("mdia has no handler")
+	}
+	return string(hdlr.body[8:12]), nil
+}
+
+// checkStreamInit checks the init segment of stream, if it has one, before
+// any of its segments are downloaded
+func checkStreamInit(kind StreamKind, stream *Stream) error {
+	if stream == nil || stream.InitSegment == "" {
+		return nil
+	}
+	data, err := base64.StdEncoding.DecodeString(stream.InitSegment)
+	if err != nil {
+		return fmt.Errorf("%s init segment: %w", kind, err)
+	}
+	if err := checkInitSegment(data, kind); err != nil {
+		return fmt.Errorf("%s init segment is invalid: %w", kind, err)
+	}
+	return nil
+}
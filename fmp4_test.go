@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func TestCheckInitSegment(t *testing.T) {
+	video := testInitSegment("vide", "avc1", nil)
+	audio := testInitSegment("soun", "mp4a", nil)
+	// The mvhd of both is right after the ftyp and moov headers
+	mvhdOffset := 16 + 8
+	noTimescale := append([]byte(nil), video...)
+	binary.BigEndian.PutUint32(noTimescale[mvhdOffset+8+12:], 0)
+
+	tests := []struct {
+		name string
+		data []byte
+		kind StreamKind
+		want string // Part of the error, "" for none
+	}{
+		{"video", video, VideoStream, ""},
+		{"audio", audio, AudioStream, ""},
+		{"truncated", video[:len(video)-5], VideoStream, "moov box at offset 16"},
+		{"truncated box header", video[:20], VideoStream, "truncated box header at offset 16"},
+		{"only the ftyp", video[:16], VideoStream, "no moov box"},
+		{"no ftyp", video[16:], VideoStream, "no ftyp box"},
+		{"other stream's", audio, VideoStream, "no video track, only soun"},
+		{"timescale of 0", noTimescale, VideoStream, "mvhd box has a timescale of 0"},
+		{"no tracks", append(testBox("ftyp", []byte("isom")), testBox("moov", testHeaderBox("mvhd", 1000))...), AudioStream, "no tracks"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkInitSegment(tt.data, tt.kind)
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("checkInitSegment: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("checkInitSegment: %v, want an error with %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadBoxesSizes(t *testing.T) {
+	// A 64-bit size, then a box running to the end
+	large := binary.BigEndian.AppendUint32(nil, 1)
+	large = append(large, "free"...)
+	large = binary.BigEndian.AppendUint64(large, 20)
+	large = append(large, "abcd"...)
+	data := append(large, 0, 0, 0, 0)
+	data = append(data, "mdat"...)
+	data = append(data, "rest"...)
+
+	boxes, err := readBoxes(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(boxes) != 2 || string(boxes[0].body) != "abcd" || boxes[1].typ != "mdat" || string(boxes[1].body) != "rest" {
+		t.Errorf("readBoxes = %+v, want free holding abcd and mdat holding rest", boxes)
+	}
+	if _, err := readBoxes(large[:12]); err == nil {
+		t.Error("readBoxes of a truncated 64-bit size succeeded")
+	}
+}
+
+func TestCheckStreamInit(t *testing.T) {
+	valid := base64.StdEncoding.EncodeToString(testInitSegment("vide", "avc1", nil))
+	if err := checkStreamInit(VideoStream, &Stream{InitSegment: valid}); err != nil {
+		t.Errorf("valid init segment: %v", err)
+	}
+	if err := checkStreamInit(VideoStream, &Stream{}); err != nil {
+		t.Errorf("no init segment: %v", err)
+	}
+	if err := checkStreamInit(VideoStream, nil); err != nil {
+		t.Errorf("no stream: %v", err)
+	}
+	if err := checkStreamInit(AudioStream, &Stream{InitSegment: "not base64!"}); err == nil {
+		t.Error("undecodable init segment passed")
+	}
+	truncated := base64.StdEncoding.EncodeToString(testInitSegment("soun", "mp4a", nil)[:40])
+	if err := checkStreamInit(AudioStream, &Stream{InitSegment: truncated}); err == nil || !strings.Contains(err.Error(), "audio init segment is invalid") {
+		t.Errorf("truncated init segment: %v, want it reported as invalid", err)
+	}
+}
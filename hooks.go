@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// HookResult is how the -exec or -exec-on-failure hook of a download ended,
+// the zero value when no hook ran
+type HookResult struct {
+	Command  string
+	ExitCode int   // -1 when it couldn't be run
+	Err      error // Why it couldn't be run
+}
+
+// Ran reports whether a hook was run
+func (h HookResult) Ran() bool {
+	return h.Command != ""
+}
+
+// Failed reports whether the hook couldn't be run or exited non-zero
+func (h HookResult) Failed() bool {
+	return h.Ran() && h.ExitCode != 0
+}
+
+func (h HookResult) String() string {
+	if h.Err != nil {
+		return fmt.Sprintf("hook could not be run: %v", h.Err)
+	}
+	return fmt.Sprintf("hook exited with status %d", h.ExitCode)
+}
+
+// runExecHooks runs the -exec command after a successful download of
+// outputs, or the -exec-on-failure command after one that failed with
+// downloadErr. A failing hook is reported but leaves the outputs alone. How
+// it ended is also stored in opts.hook for the batch and rendition summaries.
+func runExecHooks(opts Options, outputs []string, downloadErr error) {
+	command := opts.Exec
+	if downloadErr != nil {
+		command = opts.ExecOnFailure
+	}
+	if command == "" || opts.DryRun || opts.CheckURLs {
+		return
+	}
+
+	// A failed download has no outputs, pass the one it was going to write
+	paths := outputs
+	if len(paths) == 0 && opts.OutputFile != "" {
+		paths = []string{opts.OutputFile}
+	}
+	command = expandExecCommand(command, paths)
+
+	cmd := shellCommand(command)
+	cmd.Stdout = os.Stdout
+	if opts.OutputFile == stdoutOutput {
+		cmd.Stdout = os.Stderr
+	}
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), "VIMEO_DOWNLOADER_URL="+opts.PlaylistURL)
+	if downloadErr != nil {
+		cmd.Env = append(cmd.Env, "VIMEO_DOWNLOADER_ERROR="+downloadErr.Error())
+	}
+
+	infof("Running hook: %s", command)
+	err := cmd.Run()
+	result := HookResult{Command: command}
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		result.ExitCode = exitErr.ExitCode()
+		warnf("%s", result)
+	case err != nil:
+		result.ExitCode, result.Err = -1, err
+		warnf("%s", result)
+	default:
+		resultf("Hook exited with status 0")
+	}
+	if opts.hook != nil {
+		*opts.hook = result
+	}
+}
+
+// expandExecCommand replaces each {} in command with the paths, quoted for
+// the shell, or appends them if there is no {}
+func expandExecCommand(command string, paths []string) string {
+	quoted := make([]string, len(paths))
+	for i, path := range paths {
+		quoted[i] = shellQuote(path)
+	}
+	args := strings.Join(quoted, " ")
+	if !strings.Contains(command, "{}") {
+		return command + " " + args
+	}
+	return strings.ReplaceAll(command, "{}", args)
+}
+
+// shellCommand runs command through the system shell, so hooks can use
+// pipes and redirections
+func shellCommand(command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", command)
+	}
+	return exec.Command("sh", "-c", command)
+}
+
+// shellQuote quotes arg for sh, or for cmd on Windows, unless it only has
+// characters that need no quoting
+func shellQuote(arg string) string {
+	if arg != "" && strings.Trim(arg, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./:=+,@%") == "" {
+		return arg
+	}
+	if runtime.GOOS == "windows" {
+		// cmd has no escape for a double quote inside quotes, but paths
+		// can't contain one
+		return `"` + arg + `"`
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// captureLog returns what fn logs at the info and result levels
+func captureLog(t *testing.T, fn func()) string {
+	t.Helper()
+	var b bytes.Buffer
+	setLogOutputs(&b, io.Discard)
+	defer setLogOutputs(io.Discard, io.Discard)
+	fn()
+	return b.String()
+}
+
+func TestRunExecHooksStatus(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      Options
+		err       error
+		want      int
+		wantRan   bool
+		wantFails bool
+	}{
+		{"success", Options{Exec: "exit 0"}, nil, 0, true, false},
+		{"failing hook", Options{Exec: "exit 3"}, nil, 3, true, true},
+		{"on failure", Options{Exec: "exit 0", ExecOnFailure: "exit 4"}, errors.New("download failed"), 4, true, true},
+		{"no hook for the outcome", Options{ExecOnFailure: "exit 4"}, nil, 0, false, false},
+		{"dry run", Options{Exec: "exit 3", DryRun: true}, nil, 0, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var result HookResult
+			tt.opts.hook = &result
+			runExecHooks(tt.opts, []string{"out.mp4"}, tt.err)
+			if result.Ran() != tt.wantRan || result.Failed() != tt.wantFails || result.ExitCode != tt.want {
+				t.Errorf("hook result %+v, want ran %v, failed %v, status %d", result, tt.wantRan, tt.wantFails, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandExecCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("quoting is for sh")
+	}
+	tests := []struct {
+		command string
+		paths   []string
+		want    string
+	}{
+		{"mv {} /srv/", []string{"out.mp4"}, "mv out.mp4 /srv/"},
+		{"ls -l", []string{"a b.mp4"}, "ls -l 'a b.mp4'"},
+		{"cp {} {}.bak", []string{"it's.mp4"}, `cp 'it'\''s.mp4' 'it'\''s.mp4'.bak`},
+		{"echo {}", []string{"v.video.mp4", "v.audio.m4a"}, "echo v.video.mp4 v.audio.m4a"},
+	}
+	for _, tt := range tests {
+		if got := expandExecCommand(tt.command, tt.paths); got != tt.want {
+			t.Errorf("expandExecCommand(%q, %q) = %q, want %q", tt.command, tt.paths, got, tt.want)
+		}
+	}
+}
+
+func TestBatchSummaryHooks(t *testing.T) {
+	results := []BatchResult{
+		{Entry: BatchEntry{URL: "https://a"}, Hook: HookResult{Command: "ok"}},
+		{Entry: BatchEntry{URL: "https://b"}, Hook: HookResult{Command: "notify", ExitCode: 2}},
+		{Entry: BatchEntry{URL: "https://c"}, Err: errors.New("boom"), Hook: HookResult{Command: "alert", ExitCode: 1}},
+	}
+	var err error
+	out := captureLog(t, func() { err = printBatchSummary(results, 3) })
+	if err == nil {
+		t.Error("printBatchSummary succeeded with a failed entry")
+	}
+	for _, want := range []string{
+		"2 of 3 hooks failed",
+		"FAILED https://c: boom (hook exited with status 1)",
+		"HOOK FAILED https://b: hook exited with status 2",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("summary doesn't have %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "https://a") {
+		t.Errorf("summary lists an entry whose hook succeeded:\n%s", out)
+	}
+}
+
+func TestRenditionSummaryHooks(t *testing.T) {
+	results := []RenditionResult{
+		{Stream: &Stream{Width: 1920, Height: 1080}, Output: "missing.mp4", Hook: HookResult{Command: "mv", ExitCode: 5}},
+	}
+	out := captureLog(t, func() { printRenditionSummary(results) })
+	if !strings.Contains(out, "hook exited with status 5") {
+		t.Errorf("summary doesn't have the hook status:\n%s", out)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// maxErrorBody bounds how much of an error response is kept, so a large
+// error page doesn't end up in the message
+const maxErrorBody = 1024
+
+// HTTPError is a response with an unexpected status. Body holds the start
+// of the response, which often says why (expired token, geo-blocking).
+type HTTPError struct {
+	StatusCode int
+	URL        string // Redacted, see redactURL
+	Body       string
+}
+
+func (e *HTTPError) Error() string {
+	msg := fmt.Sprintf("HTTP %d for %s", e.StatusCode, e.URL)
+	if e.Body != "" {
+		msg += ": " + e.Body
+	}
+	return msg
+}
+
+// newHTTPError builds an HTTPError from resp, reading at most
+// maxErrorBody bytes of its body
+func newHTTPError(resp *http.Response, urlStr string) *HTTPError {
+	e := &HTTPError{StatusCode: resp.StatusCode, URL: redactURL(urlStr)}
+	body, err := decodeBody(resp.Body, resp.Header.Get("Content-Encoding"))
+	if err != nil {
+		return e
+	}
+	defer body.Close()
+	data, _ := io.ReadAll(io.LimitReader(body, maxErrorBody))
+	// Collapse the whitespace of HTML and JSON bodies onto one line
+	e.Body = strings.Join(strings.Fields(string(data)), " ")
+	return e
+}
+
+// isTransient reports whether a request that failed with err may succeed
+// when retried: server errors, rate limiting, and network failures, but not
+// statuses like 403, 404, and 410 or a malformed URL
+func isTransient(err error) bool {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		switch httpErr.StatusCode {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests:
+			return true
+		}
+		return httpErr.StatusCode >= 500
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) && urlErr.Op == "parse" {
+		return false
+	}
+	return true
+}
+
+// redactURL strips the query string and key=value path segments (Vimeo
+// puts exp=...~hmac=... tokens in the path) and shortens long paths so URLs
+// can be logged safely
+func redactURL(urlStr string) string {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return "<invalid URL>"
+	}
+	query := ""
+	if u.RawQuery != "" {
+		query = "?REDACTED"
+	}
+	parts := strings.Split(u.Path, "/")
+	for i, part := range parts {
+		if strings.Contains(part, "=") {
+			parts[i] = "REDACTED"
+		}
+	}
+	u.Path = strings.Join(parts, "/")
+	u.RawPath = ""
+	u.RawQuery = ""
+	u.User = nil
+	s := u.String()
+	if len(s) > 120 {
+		s = s[:60] + "..." + s[len(s)-57:]
+	}
+	return s + query
+}
+
+// redactURLError redacts the URL that net/http puts in transport errors
+func redactURLError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		urlErr.URL = redactURL(urlErr.URL)
+	}
+	return err
+}
+
+// isAuthFailure reports whether err is a 403 or 410, which is what CDNs
+// answer to a URL whose token has expired
+func isAuthFailure(err error) bool {
+	var httpErr *HTTPError
+	return errors.As(err, &httpErr) && (httpErr.StatusCode == http.StatusForbidden || httpErr.StatusCode == http.StatusGone)
+}
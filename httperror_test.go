@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&HTTPError{StatusCode: 500}, true},
+		{&HTTPError{StatusCode: 503}, true},
+		{&HTTPError{StatusCode: 429}, true},
+		{&HTTPError{StatusCode: 408}, true},
+		{fmt.Errorf("segment 3: %w", &HTTPError{StatusCode: 502}), true},
+		{&HTTPError{StatusCode: 403}, false},
+		{&HTTPError{StatusCode: 404}, false},
+		{&HTTPError{StatusCode: 410}, false},
+		{&url.Error{Op: "parse", URL: "::", Err: errors.New("missing protocol scheme")}, false},
+		{&url.Error{Op: "Get", URL: "https://host", Err: errors.New("connection reset by peer")}, true},
+	}
+	for _, tt := range tests {
+		if got := isTransient(tt.err); got != tt.want {
+			t.Errorf("isTransient(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestFetchWithRetry(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := requests.Add(1)
+		switch {
+		case r.URL.Path == "/missing":
+			http.NotFound(w, r)
+		case n <= 2:
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte(`{"clip_id": "ok"}`))
+		}
+	}))
+	defer srv.Close()
+
+	d := &Downloader{Concurrent: 1, MaxRetries: 3}
+	data, _, err := d.fetchWithRetry(srv.URL + "/playlist.json")
+	if err != nil {
+		t.Fatalf("fetchWithRetry: %v", err)
+	}
+	if string(data) != `{"clip_id": "ok"}` || requests.Load() != 3 {
+		t.Errorf("got %q after %d requests, want the playlist after 3", data, requests.Load())
+	}
+
+	requests.Store(10)
+	_, _, err = d.fetchWithRetry(srv.URL + "/missing")
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusNotFound {
+		t.Fatalf("fetchWithRetry = %v, want a 404", err)
+	}
+	if n := requests.Load() - 10; n != 1 {
+		t.Errorf("404 requested %d times, want once", n)
+	}
+	if !strings.Contains(httpErr.Error(), "404 page not found") {
+		t.Errorf("error %q doesn't include the response body", httpErr)
+	}
+}
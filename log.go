@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// LevelResult is for the outcome of a run, which is shown even with -q
+const LevelResult = slog.Level(2)
+
+// logger is where all of the tool's output goes, apart from the progress
+// bar, prompts, usage, and machine-readable output
+var (
+	logLevel            = slog.LevelInfo
+	logOut    io.Writer = os.Stdout
+	logErrOut io.Writer = os.Stderr
+	logger              = slog.New(newConsoleHandler(logOut, logErrOut, logLevel))
+)
+
+// setLogLevel switches logger to the given minimum level
+func setLogLevel(level slog.Level) {
+	logLevel = level
+	logger = slog.New(newConsoleHandler(logOut, logErrOut, logLevel))
+}
+
+// setLogOutput sends info and result messages to w instead of stdout
+func setLogOutput(w io.Writer) {
+	setLogOutputs(w, logErrOut)
+}
+
+// setLogOutputs sends info and result messages to out, and warnings,
+// errors, and debug messages to errOut
+func setLogOutputs(out, errOut io.Writer) {
+	logOut, logErrOut = out, errOut
+	logger = slog.New(newConsoleHandler(logOut, logErrOut, logLevel))
+}
+
+func infof(format string, args ...any) {
+	logger.Info(fmt.Sprintf(format, args...))
+}
+
+func resultf(format string, args ...any) {
+	logger.Log(context.Background(), LevelResult, fmt.Sprintf(format, args...))
+}
+
+func warnf(format string, args ...any) {
+	logger.Warn(fmt.Sprintf(format, args...))
+}
+
+func errorf(format string, args ...any) {
+	logger.Error(fmt.Sprintf(format, args...))
+}
+
+// consoleHandler is a slog.Handler producing plain console output. Info and
+// result messages go to out as-is, warnings and errors go to errOut with a
+// "Warning: " or "Error: " prefix, and debug messages go to errOut with their
+// attributes as key=value pairs.
+type consoleHandler struct {
+	level  slog.Level
+	out    io.Writer
+	errOut io.Writer
+	mu     *sync.Mutex
+	attrs  []slog.Attr
+	group  string
+}
+
+func newConsoleHandler(out, errOut io.Writer, level slog.Level) *consoleHandler {
+	return &consoleHandler{level: level, out: out, errOut: errOut, mu: &sync.Mutex{}}
+}
+
+func (h *consoleHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *consoleHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	w := h.out
+	switch {
+	case r.Level >= slog.LevelError:
+		w = h.errOut
+		b.WriteString("Error: ")
+	case r.Level >= slog.LevelWarn:
+		w = h.errOut
+		b.WriteString("Warning: ")
+	case r.Level < slog.LevelInfo:
+		w = h.errOut
+		b.WriteString("[debug] ")
+	}
+	b.WriteString(r.Message)
+
+	writeAttr := func(a slog.Attr) {
+		if a.Equal(slog.Attr{}) {
+			return
+		}
+		key := a.Key
+		if h.group != "" {
+			key = h.group + "." + key
+		}
+		fmt.Fprintf(&b, " %s=%v", key, a.Value.Resolve())
+	}
+	for _, a := range h.attrs {
+		writeAttr(a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		writeAttr(a)
+		return true
+	})
+	b.WriteByte('\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (h *consoleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = append(append([]slog.Attr{}, h.attrs...), attrs...)
+	return &h2
+}
+
+func (h *consoleHandler) WithGroup(name string) slog.Handler {
+	h2 := *h
+	if h2.group != "" {
+		name = h2.group + "." + name
+	}
+	h2.group = name
+	return &h2
+}
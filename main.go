@@ -1,70 +1,218 @@
 package main
 
 import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
-// Global HTTP client with connection pooling for better performance
-var httpClient = &http.Client{
-	Timeout: 120 * time.Second,
-	Transport: &http.Transport{
-		MaxIdleConns:        100,
-		MaxIdleConnsPerHost: 100,
-		MaxConnsPerHost:     100,
-		IdleConnTimeout:     90 * time.Second,
-	},
+// stdoutOutput is the -o value that streams the output to stdout
+const stdoutOutput = "-"
+
+// defaultMaxConcurrency is the default -max-concurrency. Far more
+// connections than this run out of file descriptors or get the client
+// throttled by the CDN rather than download faster.
+const defaultMaxConcurrency = 64
+
+// Default HTTP timeouts, overridable with -timeout, -connect-timeout, and
+// -header-timeout
+const (
+	defaultTimeout        = 120 * time.Second
+	defaultConnectTimeout = 30 * time.Second
+	defaultHeaderTimeout  = 60 * time.Second
+)
+
+// Global HTTP client with connection pooling for better performance, used
+// by every Downloader without a Client of its own
+var httpClient = newHTTPClient(defaultTimeout, defaultConnectTimeout, defaultHeaderTimeout, nil, "", nil)
+
+// newHTTPClient returns a pooling client. timeout bounds a whole request
+// including reading the body, connectTimeout bounds dialing and the TLS
+// handshake, and headerTimeout bounds the wait for the response headers, so
+// a dead connection fails fast while a large transfer can run up to timeout.
+// Zero disables the respective timeout. A nil tlsConfig uses the system
+// defaults. Connections are restricted to network, tcp4 or tcp6, unless it
+// is "", and hostnames are looked up with resolver, the system's when nil.
+func newHTTPClient(timeout, connectTimeout, headerTimeout time.Duration, tlsConfig *tls.Config, network string, resolver *net.Resolver) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: 30 * time.Second,
+		Resolver:  resolver,
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:           restrictNetwork(dialer.DialContext, network),
+			TLSClientConfig:       tlsConfig,
+			TLSHandshakeTimeout:   connectTimeout,
+			ResponseHeaderTimeout: headerTimeout,
+			MaxIdleConns:          100,
+			MaxIdleConnsPerHost:   100,
+			MaxConnsPerHost:       100,
+			IdleConnTimeout:       90 * time.Second,
+		},
+	}
 }
 
 // Playlist represents the Vimeo playlist.json structure
 type Playlist struct {
-	ClipID  string   `json:"clip_id"`
-	BaseURL string   `json:"base_url"`
-	Video   []Stream `json:"video"`
-	Audio   []Stream `json:"audio"`
+	ClipID            string          `json:"clip_id"` // {clip_id} of -output-template
+	BaseURL           string          `json:"base_url"`
+	Video             []Stream        `json:"video"`
+	Audio             []Stream        `json:"audio"`
+	ContentProtection json.RawMessage `json:"content_protection,omitempty"`
 }
 
-// Stream represents a video or audio stream
+// Stream represents a video or audio stream. The -output-template
+// placeholders of a download come from its video stream, or its audio
+// stream when it has no video, with {index} its position in the playlist.
 type Stream struct {
-	ID                 string    `json:"id"`
-	BaseURL            string    `json:"base_url"`
-	Format             string    `json:"format"`
-	MimeType           string    `json:"mime_type"`
-	Codecs             string    `json:"codecs"`
-	Bitrate            int       `json:"bitrate"`
-	AvgBitrate         int       `json:"avg_bitrate"`
-	Duration           float64   `json:"duration"`
-	Framerate          float64   `json:"framerate"`
-	Width              int       `json:"width"`
-	Height             int       `json:"height"`
-	MaxSegmentDuration float64   `json:"max_segment_duration"`
-	InitSegment        string    `json:"init_segment"`
-	InitSegmentURL     string    `json:"init_segment_url"`
-	IndexSegment       string    `json:"index_segment"`
-	Segments           []Segment `json:"segments"`
+	ID                 string          `json:"id"`
+	BaseURL            string          `json:"base_url"`
+	Format             string          `json:"format"`
+	MimeType           string          `json:"mime_type"`
+	Codecs             string          `json:"codecs"`  // {codec}, as the -codec name (h264, av1, ...)
+	Bitrate            int             `json:"bitrate"` // In bps, {bitrate} is Bitrate/1000 in kbps
+	AvgBitrate         int             `json:"avg_bitrate"`
+	Duration           float64         `json:"duration"`
+	Framerate          float64         `json:"framerate"`
+	Width              int             `json:"width"`  // {width}
+	Height             int             `json:"height"` // {height}
+	MaxSegmentDuration float64         `json:"max_segment_duration"`
+	InitSegment        string          `json:"init_segment"`
+	InitSegmentURL     string          `json:"init_segment_url"`
+	IndexSegment       string          `json:"index_segment"`
+	Segments           []Segment       `json:"segments"`
+	ContentProtection  json.RawMessage `json:"content_protection,omitempty"`
 }
 
 // Segment represents a single segment
 type Segment struct {
-	Start float64 `json:"start"`
-	End   float64 `json:"end"`
-	URL   string  `json:"url"`
-	Size  int     `json:"size"`
+	Start float64    `json:"start"`
+	End   float64    `json:"end"`
+	URL   string     `json:"url"`
+	Size  int        `json:"size"`
+	Range *ByteRange `json:"range,omitempty"` // Set when the segment is part of a single media file
+}
+
+// ByteRange is an inclusive byte range, written in JSON as "start-end"
+type ByteRange struct {
+	Start int64
+	End   int64
+}
+
+func (r *ByteRange) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	start, end, ok := strings.Cut(s, "-")
+	var err error
+	if ok {
+		if r.Start, err = strconv.ParseInt(start, 10, 64); err == nil {
+			r.End, err = strconv.ParseInt(end, 10, 64)
+		}
+	}
+	if !ok || err != nil || r.Start < 0 || r.End < r.Start {
+		return fmt.Errorf("invalid byte range %q", s)
+	}
+	return nil
+}
+
+func (r ByteRange) MarshalJSON() ([]byte, error) {
+	return json.Marshal(fmt.Sprintf("%d-%d", r.Start, r.End))
+}
+
+// Len returns the number of bytes in the range
+func (r ByteRange) Len() int64 {
+	return r.End - r.Start + 1
+}
+
+// StreamKind identifies which track of a playlist a stream belongs to
+type StreamKind int
+
+const (
+	VideoStream StreamKind = iota
+	AudioStream
+)
+
+func (k StreamKind) String() string {
+	switch k {
+	case VideoStream:
+		return "video"
+	case AudioStream:
+		return "audio"
+	}
+	return fmt.Sprintf("StreamKind(%d)", int(k))
+}
+
+// ProgressFunc receives download progress for a single stream. It is always
+// invoked from one reporter goroutine, so implementations need no locking.
+type ProgressFunc func(stream StreamKind, completed, total int, bytes int64)
+
+// Downloader fetches the segments of a video and an audio stream in parallel
+type Downloader struct {
+	Concurrent   int               // Concurrent segment downloads, shared by the streams
+	PerStream    bool              // Allow Concurrent downloads for each stream instead of in total
+	ProgressFunc ProgressFunc      // Optional progress hook, called every 500ms and once on completion
+	Headers      map[string]string // Request headers, defaultHeaders when nil
+	Client       *http.Client      // Client for all requests, the shared httpClient when nil
+	Query        string            // Query string added to segment URLs that have none, e.g. an auth token
+	MaxRetries   int               // Retries of a failed segment or playlist request
+	AllowMissing int               // Failed segments tolerated per stream, left out of the output
+	MaxSize      int64             // Bytes of segments to download in total, 0 for no limit
+	Slots        chan struct{}     // Optional request slots shared with other Downloaders, on top of Concurrent
+	Metrics      *Metrics          // Optional counters of the downloads, see -metrics-addr
+	Session      *Session          // Optional cookies and responses shared with other Downloaders, for Client when nil
+
+	// SegmentFunc is an optional hook receiving every downloaded segment.
+	// It is called concurrently from the download goroutines.
+	SegmentFunc func(stream StreamKind, index int, url string, data []byte)
+
+	// Refresh optionally fetches the playlist again when the segment URLs
+	// expire, returning it with the prefix and query of the fresh URLs
+	Refresh func() (playlist Playlist, baseURLPrefix, query string, err error)
+
+	missing      [2][]int     // Segments left out of the last download of each stream
+	playlistHost string       // Host the playlist came from, to tell when segments don't
+	segmentHosts sync.Map     // Other hosts segments came from, each logged once
+	downloaded   atomic.Int64 // Bytes of segments downloaded, checked against MaxSize
+
+	freshMu         sync.Mutex
+	fresh           *freshPlaylist // Latest playlist fetched by Refresh
+	freshGeneration int            // Number of times Refresh was called
+}
+
+// streamProgress holds the live counters for one stream download
+type streamProgress struct {
+	kind      StreamKind
+	total     int
+	completed int64
+	bytes     int64
 }
 
+// defaultHeaders mimic the Vimeo web player in a desktop browser
 var defaultHeaders = map[string]string{
 	"User-Agent":      "Mozilla/5.0 (X11; Linux x86_64; rv:146.0) Gecko/20100101 Firefox/146.0",
 	"Accept":          "*/*",
@@ -77,76 +225,531 @@ var defaultHeaders = map[string]string{
 	"DNT":             "1",
 }
 
+// Options holds the command line settings for downloading a video
+type Options struct {
+	PlaylistURL          string
+	PlaylistFile         string
+	OutputFile           string
+	OutputTemplate       string
+	Title                string
+	Artist               string
+	Comment              string
+	Thumbnail            string
+	StartTime            string
+	EndTime              string
+	Trim                 bool
+	TempDir              string
+	KeepTemp             bool
+	Overwrite            bool
+	NoOverwrite          bool
+	Force                bool
+	Format               string
+	Concurrent           int
+	MaxConcurrency       int
+	PerStreamConcurrency bool
+	ListOnly             bool
+	Probe                bool
+	JSONOutput           bool
+	VideoQuality         string
+	VideoIndex           int
+	AudioIndex           int
+	MaxBitrate           int
+	TargetBitrate        int
+	Codec                string
+	AllQualities         bool
+
+	SkipMux bool
+
+	BatchFile       string
+	ContinueOnError bool
+
+	Verbose bool
+	Quiet   bool
+
+	Timeout        time.Duration
+	ConnectTimeout time.Duration
+	HeaderTimeout  time.Duration
+	UserAgent      string
+	Insecure       bool
+	CACert         string
+	ForceIPv4      bool
+	ForceIPv6      bool
+	DNS            string
+	QueryToken     string
+
+	NoFallback   bool
+	MaxFallbacks int
+
+	Progress     string
+	ProgressFile string
+
+	Checksum     bool
+	ManifestFile string
+	VerifyFile   string
+	SaveSegments string
+
+	Subs       bool
+	SubsLang   string
+	SubsFormat string
+
+	DryRun    bool
+	CheckURLs bool
+
+	MaxRetries int
+
+	ConfigFile string
+
+	VerifyTimeline bool
+	Strict         bool
+
+	FastStart  bool
+	NoReencode bool
+
+	AllowMissing int
+
+	MaxSize string
+
+	MuxWorkers     int
+	ParallelVideos int
+
+	MetricsAddr string
+
+	Exec          string
+	ExecOnFailure string
+
+	// Set by run and runBatch, not by flags
+	client        *http.Client // Built from the network flags
+	metrics       *Metrics
+	muxQueue      *muxQueue
+	batchIndex    int
+	batchProgress *batchProgress
+	segmentSlots  chan struct{}
+	session       *Session
+	sharedAudio   *renditionAudio
+	hook          *HookResult // Where runExecHooks reports to
+}
+
 func main() {
+	if err := run(); err != nil {
+		errorf("%v", err)
+		os.Exit(1)
+	}
+}
+
+// run is the whole program. It is the only place main exits from, so the
+// deferred cleanup of every step runs before the process ends.
+func run() error {
 	// Parse command line flags
-	playlistURL := flag.String("url", "", "Playlist JSON URL")
-	playlistFile := flag.String("file", "", "Local playlist JSON file")
-	outputFile := flag.String("o", "output.mp4", "Output filename")
-	concurrent := flag.Int("c", 16, "Number of concurrent downloads per stream")
-	listOnly := flag.Bool("list", false, "List available streams without downloading")
-	videoQuality := flag.String("quality", "best", "Video quality: best, worst, or resolution like 1080, 720, 360")
+	var opts Options
+	flag.StringVar(&opts.PlaylistURL, "url", "", "Playlist JSON URL")
+	flag.StringVar(&opts.PlaylistFile, "file", "", "Local playlist JSON file, or - to read it from stdin")
+	flag.StringVar(&opts.OutputFile, "o", "", "Output filename, s3://bucket/key, or - for stdout (default: derived from the video title or clip ID)")
+	flag.StringVar(&opts.OutputTemplate, "output-template", "", "Name outputs not given with -o after a template like {clip_id}_{height}p.mp4, with {clip_id}, {index}, {width}, {height}, {bitrate}, and {codec}")
+	flag.StringVar(&opts.Title, "title", "", "Title metadata (default: video title, else clip ID)")
+	flag.StringVar(&opts.Artist, "artist", "", "Artist metadata (default: video owner from the player config)")
+	flag.StringVar(&opts.Comment, "comment", "", "Comment metadata (default: source URL)")
+	flag.StringVar(&opts.Thumbnail, "thumbnail", "", "Cover art image URL (default: thumbnail from the player config)")
+	flag.StringVar(&opts.StartTime, "start", "", "Only download from this time (HH:MM:SS or seconds)")
+	flag.StringVar(&opts.EndTime, "end", "", "Only download up to this time (HH:MM:SS or seconds)")
+	flag.BoolVar(&opts.Trim, "trim", false, "With -start/-end, trim the output to the exact boundaries")
+	flag.StringVar(&opts.TempDir, "temp-dir", "", "Directory for intermediate files (default: system temp directory)")
+	flag.BoolVar(&opts.KeepTemp, "keep-temp", false, "Keep the intermediate video and audio files")
+	flag.BoolVar(&opts.Overwrite, "y", false, "Overwrite the output file without asking")
+	flag.BoolVar(&opts.NoOverwrite, "n", false, "Never overwrite the output file, exit instead")
+	flag.BoolVar(&opts.Force, "force", false, "Skip the free disk space and -max-size estimate checks")
+	flag.StringVar(&opts.Format, "format", "", "Output container: mp4, mkv, mov, or webm (default: from -o extension, else by codec)")
+	flag.IntVar(&opts.Concurrent, "c", 16, "Number of concurrent downloads, shared by the video and audio streams")
+	flag.IntVar(&opts.MaxConcurrency, "max-concurrency", defaultMaxConcurrency, "Highest -c allowed, larger values are lowered to it with a warning")
+	flag.BoolVar(&opts.ListOnly, "list", false, "List available streams without downloading")
+	flag.BoolVar(&opts.Probe, "probe", false, "Print a table of the streams' technical details (codec profile and level, bitrates, segments, size) without downloading")
+	flag.BoolVar(&opts.JSONOutput, "json", false, "With -list, print the streams as JSON")
+	flag.StringVar(&opts.VideoQuality, "quality", "best", "Video quality: best, worst, or resolution like 1080, 720, 360")
+	flag.IntVar(&opts.VideoIndex, "video-index", -1, "Select the video stream by its -list index (overrides -quality)")
+	flag.IntVar(&opts.AudioIndex, "audio-index", -1, "Select the audio stream by its -list index")
+	flag.IntVar(&opts.MaxBitrate, "max-bitrate", 0, "Select the highest resolution video at or below this bitrate in kbps (overrides -quality)")
+	flag.IntVar(&opts.TargetBitrate, "target-bitrate", 0, "Select the video with the bitrate closest to this value in kbps (overrides -quality)")
+	flag.StringVar(&opts.Codec, "codec", "", "Comma-separated video codecs to prefer at the selected resolution, e.g. av1,hevc,h264")
+	flag.BoolVar(&opts.SkipMux, "skip-mux", false, "Keep the video and audio as separate files instead of muxing with ffmpeg")
+	flag.StringVar(&opts.BatchFile, "batch", "", "File of playlist URLs to download, one per line")
+	flag.BoolVar(&opts.ContinueOnError, "continue-on-error", false, "With -batch, keep going after a failed download")
+	flag.BoolVar(&opts.Verbose, "v", false, "Log HTTP requests and retries")
+	flag.BoolVar(&opts.Verbose, "verbose", false, "Log HTTP requests and retries")
+	flag.BoolVar(&opts.Quiet, "q", false, "Only print warnings, errors, and the final result")
+	flag.BoolVar(&opts.Quiet, "quiet", false, "Only print warnings, errors, and the final result")
+	flag.DurationVar(&opts.Timeout, "timeout", defaultTimeout, "Overall timeout per HTTP request, including the body (0 for none)")
+	flag.DurationVar(&opts.ConnectTimeout, "connect-timeout", defaultConnectTimeout, "Timeout for connecting to a server (0 for none)")
+	flag.DurationVar(&opts.HeaderTimeout, "header-timeout", defaultHeaderTimeout, "Timeout waiting for a server to start responding (0 for none)")
+	flag.StringVar(&opts.UserAgent, "user-agent", "", "User-Agent header for all requests (default: Firefox on Linux)")
+	flag.BoolVar(&opts.Insecure, "insecure", false, "Skip TLS certificate verification (unsafe)")
+	flag.StringVar(&opts.CACert, "ca-cert", "", "PEM file of extra CA certificates to trust, e.g. for a TLS-intercepting proxy")
+	flag.BoolVar(&opts.ForceIPv4, "force-ipv4", false, "Only connect over IPv4")
+	flag.BoolVar(&opts.ForceIPv6, "force-ipv6", false, "Only connect over IPv6")
+	flag.StringVar(&opts.DNS, "dns", "", "DNS server to resolve hostnames with, e.g. 1.1.1.1 (default: the system's)")
+	flag.StringVar(&opts.QueryToken, "query-token", "", "Query string to add to segment URLs that have none (default: the playlist URL's, when needed)")
+	flag.BoolVar(&opts.NoFallback, "no-fallback", false, "Fail instead of falling back to a lower video rendition when the selected one fails")
+	flag.IntVar(&opts.MaxFallbacks, "max-fallbacks", 2, "Maximum number of lower video renditions to fall back to")
+	flag.StringVar(&opts.Progress, "progress", ProgressBar, "Progress output: bar, json (newline-delimited, to stderr), or none")
+	flag.StringVar(&opts.ProgressFile, "progress-file", "", "With -progress json, write the updates to this file or named pipe instead of stderr")
+	flag.BoolVar(&opts.Checksum, "checksum", false, "Print the SHA-256 of the output")
+	flag.StringVar(&opts.ManifestFile, "manifest", "", "Write a JSON manifest with the SHA-256 of the output and of every segment")
+	flag.StringVar(&opts.VerifyFile, "verify", "", "Check existing output against a -manifest file instead of downloading")
+	flag.StringVar(&opts.SaveSegments, "save-segments", "", "Also keep the raw segments in this directory, in a subdirectory per stream")
+	flag.BoolVar(&opts.AllQualities, "all-qualities", false, "Download every video rendition, each muxed with the best audio into <output>_<height>p")
+	flag.BoolVar(&opts.PerStreamConcurrency, "per-stream-concurrency", false, "Apply -c to the video and audio streams separately, doubling the connections")
+	flag.BoolVar(&opts.Subs, "subs", false, "Download the subtitles from the player config, embedded when muxing, else as sidecar files")
+	flag.StringVar(&opts.SubsLang, "subs-lang", "", "Comma-separated subtitle languages to download, e.g. en,fr (implies -subs, default: all)")
+	flag.StringVar(&opts.SubsFormat, "subs-format", "vtt", "Format of sidecar subtitle files: vtt or srt")
+	flag.BoolVar(&opts.DryRun, "dry-run", false, "Print the selected streams, output, and ffmpeg command, then exit without downloading")
+	flag.BoolVar(&opts.CheckURLs, "check-urls", false, "Check that the selected streams' segments are reachable and match the playlist's sizes, without downloading them")
+	flag.IntVar(&opts.MaxRetries, "max-retries", 3, "Retries of a failed segment or playlist request")
+	flag.BoolVar(&opts.VerifyTimeline, "verify-timeline", false, "Check the segment timestamps for gaps and overlaps, and write out-of-order segments by start time")
+	flag.BoolVar(&opts.Strict, "strict", false, "With -verify-timeline, fail instead of warning when the timeline is inconsistent")
+	flag.BoolVar(&opts.FastStart, "faststart", false, "Move the index of MP4 and MOV outputs to the front so they play while being streamed")
+	flag.BoolVar(&opts.NoReencode, "no-reencode", false, "Fail instead of reencoding when ffmpeg can't copy the streams into the container")
+	flag.IntVar(&opts.AllowMissing, "allow-missing", 0, "Number of failed segments per stream to leave out instead of failing the download")
+	flag.StringVar(&opts.MaxSize, "max-size", "", "Abort a download once its segments exceed this size, e.g. 500M or 2G")
+	flag.IntVar(&opts.MuxWorkers, "mux-workers", 0, "With -batch, mux up to this many videos in the background while the next ones download (default: 0, mux before the next download)")
+	flag.IntVar(&opts.ParallelVideos, "parallel-videos", 1, "With -batch, download up to this many videos at once, sharing the -c connections")
+	flag.StringVar(&opts.MetricsAddr, "metrics-addr", "", "Serve Prometheus metrics of the downloads at /metrics on this address, e.g. :9090")
+	flag.StringVar(&opts.Exec, "exec", "", "Shell command to run after a successful download, {} is replaced by the quoted output path")
+	flag.StringVar(&opts.ExecOnFailure, "exec-on-failure", "", "Shell command to run after a failed download, {} is replaced by the quoted output path")
+	flag.StringVar(&opts.ConfigFile, "config", "", "JSON file of defaults for these flags (default: vimeo-downloader/config.json in the user config directory)")
 	flag.Parse()
 
-	if *playlistURL == "" && *playlistFile == "" {
+	// Flags given on the command line take precedence over the config file
+	configFile, required := opts.ConfigFile, true
+	if configFile == "" {
+		configFile, required = defaultConfigFile(), false
+	}
+	if configFile != "" {
+		if err := applyConfigFile(flag.CommandLine, configFile, required); err != nil {
+			return err
+		}
+	}
+
+	if opts.PlaylistURL == "" && opts.PlaylistFile == "" && opts.BatchFile == "" && opts.VerifyFile == "" {
 		fmt.Println("Vimeo Downloader")
 		fmt.Println("================")
 		fmt.Println()
 		fmt.Println("Usage:")
 		fmt.Println("  vimeo-downloader -url <playlist_url> -o output.mp4")
 		fmt.Println("  vimeo-downloader -file playlist.json -url <playlist_url> -o output.mp4")
+		fmt.Println("  vimeo-downloader -batch urls.txt")
+		fmt.Println("  vimeo-downloader -verify manifest.json")
 		fmt.Println()
 		fmt.Println("Options:")
-		fmt.Println("  -url string      Playlist JSON URL from Vimeo")
-		fmt.Println("  -file string     Local playlist JSON file (requires -url for base URL)")
-		fmt.Println("  -o string        Output filename (default: output.mp4)")
-		fmt.Println("  -c int           Number of concurrent downloads per stream (default: 16)")
+		fmt.Println("  -url string      Playlist JSON or player config URL from Vimeo")
+		fmt.Println("  -file string     Local playlist JSON file, or - for stdin (requires -url for base URL)")
+		fmt.Println("  -batch string    File of playlist URLs, one per line, optionally url|output.mp4")
+		fmt.Println("  -continue-on-error")
+		fmt.Println("                   With -batch, keep going after a failed download")
+		fmt.Println("  -mux-workers int With -batch, mux this many videos in the background while the next downloads")
+		fmt.Println("  -parallel-videos int")
+		fmt.Println("                   With -batch, download this many videos at once, sharing the -c connections (default: 1)")
+		fmt.Println("  -o string        Output filename, s3://bucket/key, or - for stdout (default: from the video title or clip ID)")
+		fmt.Println("  -output-template string")
+		fmt.Println("                   Name outputs not given with -o after a template like {clip_id}_{height}p.mp4, with")
+		fmt.Println("                   {clip_id}, {index}, {width}, {height}, {bitrate}, and {codec}")
+		fmt.Println("  -format string   Output container: mp4, mkv, mov, or webm (default: -o extension or codecs)")
+		fmt.Println("  -c int           Number of concurrent downloads in total (default: 16)")
+		fmt.Println("  -max-concurrency int")
+		fmt.Println("                   Highest -c allowed, larger values are lowered to it (default: 64)")
+		fmt.Println("  -per-stream-concurrency")
+		fmt.Println("                   Apply -c to the video and audio streams separately")
 		fmt.Println("  -quality string  Video quality: best, worst, or resolution (default: best)")
+		fmt.Println("  -video-index int Select the video stream by its -list index (overrides -quality)")
+		fmt.Println("  -audio-index int Select the audio stream by its -list index")
+		fmt.Println("  -max-bitrate int Select the highest resolution video at or below this kbps (overrides -quality)")
+		fmt.Println("  -target-bitrate int")
+		fmt.Println("                   Select the video with the bitrate closest to this kbps (overrides -quality)")
+		fmt.Println("  -codec string    Video codecs to prefer at the selected resolution, e.g. av1,hevc,h264")
+		fmt.Println("  -all-qualities   Download every video rendition to <output>_<height>p.mp4, each with the best audio")
+		fmt.Println("  -title string    Title metadata (default: video title, else clip ID)")
+		fmt.Println("  -artist string   Artist metadata (default: video owner)")
+		fmt.Println("  -comment string  Comment metadata (default: source URL)")
+		fmt.Println("  -thumbnail string")
+		fmt.Println("                   Cover art image URL (default: thumbnail from the player config)")
+		fmt.Println("  -subs            Download subtitles (player config URLs only), embedded when muxing")
+		fmt.Println("  -subs-lang string")
+		fmt.Println("                   Subtitle languages, e.g. en,fr (implies -subs, default: all)")
+		fmt.Println("  -subs-format string")
+		fmt.Println("                   Sidecar subtitle format: vtt or srt (default: vtt)")
+		fmt.Println("  -start string    Only download from this time (HH:MM:SS or seconds)")
+		fmt.Println("  -end string      Only download up to this time (HH:MM:SS or seconds)")
+		fmt.Println("  -trim            With -start/-end, trim to the exact boundaries")
+		fmt.Println("  -faststart       Move the MP4/MOV index to the front for playback while streaming")
+		fmt.Println("  -no-reencode     Fail instead of reencoding when the streams can't be copied into the container")
+		fmt.Println("  -temp-dir string Directory for intermediate files (default: system temp)")
+		fmt.Println("  -keep-temp       Keep the intermediate video and audio files")
+		fmt.Println("  -skip-mux        Write separate <output>.video.mp4 and <output>.audio.m4a files")
+		fmt.Println("  -verify-timeline Check segment timestamps for gaps and overlaps, reorder by start time")
+		fmt.Println("  -strict          With -verify-timeline, fail on an inconsistent timeline")
+		fmt.Println("  -no-fallback     Fail instead of falling back to a lower video rendition")
+		fmt.Println("  -max-fallbacks int")
+		fmt.Println("                   Lower video renditions to try when the selected one fails (default: 2)")
+		fmt.Println("  -y               Overwrite the output file without asking")
+		fmt.Println("  -n               Never overwrite the output file, exit instead")
+		fmt.Println("  -force           Skip the free disk space and -max-size estimate checks")
+		fmt.Println("  -user-agent string")
+		fmt.Println("                   User-Agent header for all requests (default: Firefox on Linux)")
+		fmt.Println("  -query-token string")
+		fmt.Println("                   Query string to add to segment URLs, e.g. 'token=...' (default: the playlist URL's)")
+		fmt.Println("  -insecure        Skip TLS certificate verification (unsafe)")
+		fmt.Println("  -ca-cert string  PEM file of extra CA certificates to trust")
+		fmt.Println("  -force-ipv4      Only connect over IPv4")
+		fmt.Println("  -force-ipv6      Only connect over IPv6")
+		fmt.Println("  -dns string      DNS server to resolve hostnames with, e.g. 1.1.1.1 (default: the system's)")
+		fmt.Println("  -max-retries int Retries of a failed segment or playlist request (default: 3)")
+		fmt.Println("  -allow-missing int")
+		fmt.Println("                   Failed segments per stream to leave out instead of failing (default: 0)")
+		fmt.Println("  -max-size string Abort a download once it exceeds this size, e.g. 500M or 2G")
+		fmt.Println("  -timeout duration")
+		fmt.Println("                   Overall timeout per HTTP request, 0 for none (default: 2m)")
+		fmt.Println("  -connect-timeout duration")
+		fmt.Println("                   Timeout for connecting to a server (default: 30s)")
+		fmt.Println("  -header-timeout duration")
+		fmt.Println("                   Timeout waiting for a server to respond (default: 1m)")
+		fmt.Println("  -checksum        Print the SHA-256 of the output")
+		fmt.Println("  -manifest string Write a JSON manifest of the output's and every segment's SHA-256")
+		fmt.Println("  -verify string   Check existing output against a manifest instead of downloading")
+		fmt.Println("  -save-segments string")
+		fmt.Println("                   Also keep the raw segments in this directory, in a subdirectory per stream")
 		fmt.Println("  -list            List available streams without downloading")
+		fmt.Println("  -probe           Print the streams' technical details as a table, those of -video-index/-audio-index if given")
+		fmt.Println("  -dry-run         Print the selected streams, output, and ffmpeg command without downloading")
+		fmt.Println("  -check-urls      Check the selected streams' segment URLs and sizes with HEAD requests, without downloading")
+		fmt.Println("  -json            With -list, print the streams as JSON to stdout")
+		fmt.Println("  -progress string Progress output: bar, json (one object per line on stderr), or none (default: bar)")
+		fmt.Println("  -progress-file string")
+		fmt.Println("                   With -progress json, write the updates to this file or named pipe")
+		fmt.Println("  -exec string     Shell command to run after each successful download, {} is the output path")
+		fmt.Println("  -exec-on-failure string")
+		fmt.Println("                   Shell command to run after each failed download")
+		fmt.Println("  -metrics-addr string")
+		fmt.Println("                   Serve Prometheus metrics at /metrics on this address, e.g. :9090")
+		fmt.Println("  -config string   JSON file of defaults for these flags")
+		fmt.Println("                   (default: ~/.config/vimeo-downloader/config.json)")
+		fmt.Println("  -v, -verbose     Log HTTP requests and retries")
+		fmt.Println("  -q, -quiet       Only print warnings, errors, and the final result")
 		fmt.Println()
 		fmt.Println("Example:")
 		fmt.Println("  vimeo-downloader -url 'https://vod-adaptive-ak.vimeocdn.com/.../playlist.json?...' -o video.mp4")
-		os.Exit(0)
+		return nil
+	}
+
+	if opts.Verbose && opts.Quiet {
+		return errors.New("-v and -q cannot be used together")
+	}
+	if opts.Verbose {
+		setLogLevel(slog.LevelDebug)
+	} else if opts.Quiet {
+		setLogLevel(LevelResult)
+	}
+	if opts.OutputFile == stdoutOutput || (opts.ListOnly && opts.JSONOutput) {
+		// stdout carries the video or the JSON listing
+		setLogOutput(os.Stderr)
+	}
+	tlsConfig, err := newTLSConfig(opts.Insecure, opts.CACert)
+	if err != nil {
+		return err
+	}
+	network, err := ipNetwork(opts.ForceIPv4, opts.ForceIPv6)
+	if err != nil {
+		return err
+	}
+	resolver, err := newDNSResolver(opts.DNS)
+	if err != nil {
+		return err
+	}
+	opts.client = newHTTPClient(opts.Timeout, opts.ConnectTimeout, opts.HeaderTimeout, tlsConfig, network, resolver)
+
+	if opts.VerifyFile != "" {
+		return verifyManifest(opts.VerifyFile)
+	}
+	if err := validateOutputTemplate(opts.OutputTemplate); err != nil {
+		return err
+	}
+	if opts.Concurrent, err = clampConcurrency(opts.Concurrent, opts.MaxConcurrency); err != nil {
+		return err
+	}
+	warnIgnoredSelection(opts)
+	if opts.MetricsAddr != "" {
+		opts.metrics = &Metrics{}
+		if err := serveMetrics(opts.MetricsAddr, opts.metrics); err != nil {
+			return err
+		}
+	}
+	if opts.BatchFile != "" {
+		return downloadBatch(opts)
+	}
+	return downloadVideo(opts)
+}
+
+// downloadBatch downloads every entry of opts.BatchFile
+func downloadBatch(opts Options) error {
+	if opts.PlaylistURL != "" || opts.PlaylistFile != "" || opts.OutputFile != "" {
+		return errors.New("-batch can't be combined with -url, -file, or -o (use url|output lines instead)")
+	}
+
+	f, err := os.Open(opts.BatchFile)
+	if err != nil {
+		return fmt.Errorf("reading batch file: %w", err)
+	}
+	entries, err := parseBatchFile(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("reading batch file: %w", err)
+	}
+	if len(entries) == 0 {
+		return errors.New("batch file has no URLs")
+	}
+	if opts.ParallelVideos < 1 {
+		return errors.New("-parallel-videos must be at least 1")
+	}
+
+	results := runBatch(opts, entries, opts.ContinueOnError)
+	return printBatchSummary(results, len(entries))
+}
+
+// downloadVideo downloads and muxes the video described by opts
+func downloadVideo(opts Options) (err error) {
+	// Failing before the download gets -exec-on-failure here, the download
+	// runs its own hooks
+	handedOff := false
+	defer func() {
+		if err != nil && !handedOff {
+			runExecHooks(opts, nil, err)
+		}
+	}()
+
+	// JSON listings must be the only thing written to stdout
+	jsonList := opts.ListOnly && opts.JSONOutput
+
+	switch opts.Progress {
+	case ProgressBar, ProgressJSON, ProgressNone:
+	default:
+		return fmt.Errorf("invalid -progress %q (use bar, json, or none)", opts.Progress)
+	}
+	if opts.MaxRetries < 0 {
+		return fmt.Errorf("-max-retries must not be negative")
+	}
+	outputFile, err := localOutputPath(opts.OutputFile)
+	if err != nil {
+		return err
+	}
+	opts.OutputFile = outputFile
+	if opts.AllowMissing < 0 {
+		return fmt.Errorf("-allow-missing must not be negative")
+	}
+	if opts.SubsFormat != "vtt" && opts.SubsFormat != "srt" {
+		return fmt.Errorf("invalid -subs-format %q (use vtt or srt)", opts.SubsFormat)
+	}
+
+	// With -o - the muxed output is streamed to stdout
+	toStdout := opts.OutputFile == stdoutOutput
+	if toStdout && opts.SkipMux {
+		return errors.New("-skip-mux writes two files and can't be used with -o -")
+	}
+
+	maxSize, err := parseByteSize(opts.MaxSize)
+	if err != nil {
+		return fmt.Errorf("invalid -max-size: %w", err)
+	}
+	// The session's client is opts.client with the batch's cookie jar
+	client := opts.client
+	if opts.session != nil {
+		client = opts.session.client
+	}
+	downloader := &Downloader{
+		Concurrent:   opts.Concurrent,
+		PerStream:    opts.PerStreamConcurrency,
+		Headers:      newHeaders(opts.UserAgent),
+		Client:       client,
+		MaxRetries:   opts.MaxRetries,
+		AllowMissing: opts.AllowMissing,
+		MaxSize:      maxSize,
+		Metrics:      opts.metrics,
+		Slots:        opts.segmentSlots,
+		Session:      opts.session,
 	}
 
 	// Load playlist
 	var playlist Playlist
 	var baseURLPrefix string
+	var config *PlayerConfig
+	var configURL string
 
-	if *playlistFile != "" {
+	if opts.PlaylistFile != "" {
 		// Load from local file
-		data, err := os.ReadFile(*playlistFile)
+		data, err := readPlaylistFile(opts.PlaylistFile, os.Stdin)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error reading playlist file: %v\n", err)
-			os.Exit(1)
-		}
-		if err := json.Unmarshal(data, &playlist); err != nil {
-			fmt.Fprintf(os.Stderr, "Error parsing playlist JSON: %v\n", err)
-			os.Exit(1)
+			return fmt.Errorf("reading playlist file: %w", err)
 		}
 		// Need a base URL for local files
-		if *playlistURL != "" {
-			baseURLPrefix = getBaseURLPrefix(*playlistURL, playlist.BaseURL)
-		} else {
-			fmt.Fprintln(os.Stderr, "Error: Using local file requires -url to set the base URL prefix")
-			os.Exit(1)
+		if opts.PlaylistURL == "" {
+			return errors.New("using local file requires -url to set the base URL prefix")
+		}
+		playlist, baseURLPrefix, err = downloader.loadPlaylist(data, opts.PlaylistURL)
+		if err != nil {
+			return err
 		}
+		downloader.playlistHost = hostOf(opts.PlaylistURL)
 	} else {
 		// Fetch from URL
-		fmt.Println("Fetching playlist...")
-		data, err := fetchURL(*playlistURL)
+		if !jsonList {
+			infof("Fetching playlist...")
+		}
+		// Relative URLs are resolved against where a redirect led, not -url
+		data, resolvedURL, err := downloader.fetchCached(opts.PlaylistURL)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error fetching playlist: %v\n", err)
-			os.Exit(1)
+			return fmt.Errorf("fetching playlist: %w", err)
+		}
+
+		// A player config points at the actual playlist
+		var ok bool
+		if config, ok = parsePlayerConfig(data); ok {
+			if hasJSONValue(config.Request.DRM) {
+				return fmt.Errorf("%w (player config requires DRM)", ErrDRMProtected)
+			}
+			configURL = resolvedURL
+			refreshFrom := opts.PlaylistURL
+			downloader.Refresh = func() (Playlist, string, string, error) {
+				return downloader.refreshFromConfig(refreshFrom, opts.QueryToken)
+			}
+			opts.PlaylistURL, err = config.PlaylistURL()
+			if err != nil {
+				return fmt.Errorf("resolving playlist: %w", err)
+			}
+			data, resolvedURL, err = downloader.fetchCached(opts.PlaylistURL)
+			if err != nil {
+				return fmt.Errorf("fetching playlist: %w", err)
+			}
 		}
-		if err := json.Unmarshal(data, &playlist); err != nil {
-			fmt.Fprintf(os.Stderr, "Error parsing playlist JSON: %v\n", err)
-			os.Exit(1)
+
+		playlist, baseURLPrefix, err = downloader.loadPlaylist(data, resolvedURL)
+		if err != nil {
+			return err
 		}
-		baseURLPrefix = getBaseURLPrefix(*playlistURL, playlist.BaseURL)
+		downloader.playlistHost = hostOf(resolvedURL)
 	}
 
-	fmt.Printf("Clip ID: %s\n", playlist.ClipID)
-	fmt.Printf("Found %d video streams, %d audio streams\n", len(playlist.Video), len(playlist.Audio))
+	// Some CDNs only serve segments with the playlist URL's signed token, or
+	// in a batch with the one an earlier entry of the same host used
+	queryHost := hostOf(opts.PlaylistURL)
+	if opts.QueryToken != "" {
+		downloader.Query = strings.TrimPrefix(opts.QueryToken, "?")
+	} else if query := segmentQuery(opts.PlaylistURL, &playlist); query != "" {
+		logger.Debug("segment URLs have no query string, adding the playlist URL's", "query", query)
+		downloader.Query = query
+	} else if opts.session != nil && segmentsLackQuery(&playlist) {
+		if query := opts.session.hostQuery(queryHost); query != "" {
+			logger.Debug("segment URLs have no query string, adding the one used before for the host", "host", queryHost, "query", query)
+			downloader.Query = query
+		}
+	}
+	if opts.session != nil && downloader.Query != "" {
+		opts.session.setHostQuery(queryHost, downloader.Query)
+	}
 
 	// Sort video streams by resolution (highest first)
 	sort.Slice(playlist.Video, func(i, j int) bool {
@@ -158,183 +761,1405 @@ func main() {
 		return playlist.Audio[i].Bitrate > playlist.Audio[j].Bitrate
 	})
 
-	// List streams
-	fmt.Println("\nVideo streams:")
-	for i, v := range playlist.Video {
-		fmt.Printf("  [%d] %dx%d, %d kbps, %.1fs, %d segments\n",
-			i, v.Width, v.Height, v.Bitrate/1000, v.Duration, len(v.Segments))
+	if jsonList {
+		if err := writeStreamListJSON(os.Stdout, &playlist, textTracks(config)); err != nil {
+			return fmt.Errorf("writing JSON: %w", err)
+		}
+		return nil
 	}
-	fmt.Println("\nAudio streams:")
-	for i, a := range playlist.Audio {
-		fmt.Printf("  [%d] %d kbps, %.1fs, %d segments\n",
-			i, a.Bitrate/1000, a.Duration, len(a.Segments))
+	if opts.Probe {
+		return probeStreams(&playlist, opts.VideoIndex, opts.AudioIndex)
 	}
 
-	if *listOnly {
-		return
+	// The listing is the result of -list, so it is shown even with -q
+	listf := infof
+	if opts.ListOnly {
+		listf = resultf
 	}
 
-	// Select video stream
-	var selectedVideo *Stream
-	switch *videoQuality {
-	case "best":
-		selectedVideo = &playlist.Video[0]
-	case "worst":
-		selectedVideo = &playlist.Video[len(playlist.Video)-1]
-	default:
-		// Try to match resolution
-		for i := range playlist.Video {
-			v := &playlist.Video[i]
-			if fmt.Sprintf("%d", v.Height) == *videoQuality ||
-				fmt.Sprintf("%dp", v.Height) == *videoQuality {
-				selectedVideo = v
-				break
-			}
-		}
-		if selectedVideo == nil {
-			fmt.Fprintf(os.Stderr, "Quality '%s' not found, using best\n", *videoQuality)
-			selectedVideo = &playlist.Video[0]
+	listf("Clip ID: %s", playlist.ClipID)
+	listf("Found %d video streams, %d audio streams", len(playlist.Video), len(playlist.Audio))
+
+	// List streams
+	listf("\nVideo streams:")
+	if len(playlist.Video) == 0 {
+		listf("  (none)")
+	}
+	for i, v := range playlist.Video {
+		listf("  [%d] %dx%d, %d kbps, %s%.1fs, %d segments",
+			i, v.Width, v.Height, v.Bitrate/1000, listCodec(v.Codecs), v.Duration, len(v.Segments))
+	}
+	listf("\nAudio streams:")
+	if len(playlist.Audio) == 0 {
+		listf("  (none)")
+	}
+	for i, a := range playlist.Audio {
+		listf("  [%d] %d kbps, %s%.1fs, %d segments",
+			i, a.Bitrate/1000, listCodec(a.Codecs), a.Duration, len(a.Segments))
+	}
+	if tracks := textTracks(config); len(tracks) > 0 {
+		listf("\nText tracks (-subs-lang):")
+		for _, t := range tracks {
+			listf("  %s: %s (%s)", t.Lang, t.Label, t.Kind)
 		}
 	}
 
-	// Select best audio
-	selectedAudio := &playlist.Audio[0]
-
-	fmt.Printf("\nSelected video: %dx%d @ %d kbps\n", selectedVideo.Width, selectedVideo.Height, selectedVideo.Bitrate/1000)
-	fmt.Printf("Selected audio: %d kbps\n", selectedAudio.Bitrate/1000)
-
-	// Create temp directory
-	tempDir, err := os.MkdirTemp("", "vimeo-download-*")
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error creating temp directory: %v\n", err)
-		os.Exit(1)
+	if opts.ListOnly {
+		return nil
 	}
-	defer os.RemoveAll(tempDir)
-
-	videoFile := filepath.Join(tempDir, "video.mp4")
-	audioFile := filepath.Join(tempDir, "audio.mp4")
-
-	// Download video and audio streams IN PARALLEL
-	fmt.Println("\nDownloading video and audio in parallel...")
 
-	var wg sync.WaitGroup
-	var videoErr, audioErr error
+	src := &playlistSource{playlist: playlist, baseURLPrefix: baseURLPrefix, config: config, configURL: configURL}
+	handedOff = true
+	if opts.AllQualities {
+		return downloadAllQualities(opts, downloader, src)
+	}
+	_, err = downloadFromPlaylist(opts, downloader, src)
+	return err
+}
 
-	// Progress tracking for both streams
-	var videoCompleted, audioCompleted int64
-	videoTotal := len(selectedVideo.Segments)
-	audioTotal := len(selectedAudio.Segments)
+// readPlaylistFile reads the -file playlist, where "-" stands for stdin
+func readPlaylistFile(name string, stdin io.Reader) ([]byte, error) {
+	if name == "-" {
+		return io.ReadAll(stdin)
+	}
+	return os.ReadFile(name)
+}
 
-	// Start video download goroutine
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		videoErr = downloadStreamSegments(selectedVideo, baseURLPrefix, videoFile, *concurrent, &videoCompleted)
-	}()
+// playlistSource is a loaded playlist, sorted best first, and what is
+// needed to download from it
+type playlistSource struct {
+	playlist      Playlist
+	baseURLPrefix string
+	config        *PlayerConfig // Player config the playlist came from, or nil
+	configURL     string        // URL of config, which its text tracks are relative to
+}
 
-	// Start audio download goroutine
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		audioErr = downloadStreamSegments(selectedAudio, baseURLPrefix, audioFile, *concurrent, &audioCompleted)
-	}()
+// downloadFromPlaylist selects streams from src according to opts,
+// downloads them, and writes the output. It returns the output files.
+func downloadFromPlaylist(opts Options, downloader *Downloader, src *playlistSource) (outputs []string, err error) {
+	playlist, baseURLPrefix, config := src.playlist, src.baseURLPrefix, src.config
+	toStdout := opts.OutputFile == stdoutOutput
 
-	// Progress reporter goroutine
-	done := make(chan struct{})
-	go func() {
-		ticker := time.NewTicker(500 * time.Millisecond)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-done:
-				return
-			case <-ticker.C:
-				vc := atomic.LoadInt64(&videoCompleted)
-				ac := atomic.LoadInt64(&audioCompleted)
-				fmt.Printf("\r  Video: %d/%d (%.1f%%) | Audio: %d/%d (%.1f%%)     ",
-					vc, videoTotal, float64(vc)/float64(videoTotal)*100,
-					ac, audioTotal, float64(ac)/float64(audioTotal)*100)
-			}
+	// Hooks run once the output is finished, which for a queued mux is in
+	// the background
+	queued := false
+	defer func() {
+		if !queued {
+			runExecHooks(opts, outputs, err)
 		}
 	}()
 
-	wg.Wait()
-	close(done)
-	fmt.Println() // New line after progress
-
-	if videoErr != nil {
-		fmt.Fprintf(os.Stderr, "Error downloading video: %v\n", videoErr)
-		os.Exit(1)
+	// Audio-only and video-only playlists are downloaded without muxing
+	if len(playlist.Video) == 0 && len(playlist.Audio) == 0 {
+		return nil, errors.New("playlist has no video or audio streams")
 	}
-	if audioErr != nil {
-		fmt.Fprintf(os.Stderr, "Error downloading audio: %v\n", audioErr)
-		os.Exit(1)
+	if len(playlist.Video) == 0 {
+		infof("\nNo video streams in playlist, downloading audio only")
 	}
-
-	// Mux video and audio with ffmpeg
-	fmt.Printf("\nMuxing with ffmpeg to %s...\n", *outputFile)
-	err = muxStreams(videoFile, audioFile, *outputFile)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error muxing: %v\n", err)
-		os.Exit(1)
+	if len(playlist.Audio) == 0 {
+		infof("\nNo audio streams in playlist, downloading video only")
 	}
 
-	// Get file size
-	info, _ := os.Stat(*outputFile)
-	fmt.Printf("\nDone! Output saved to: %s (%.2f MB)\n", *outputFile, float64(info.Size())/(1024*1024))
-}
+	// Select video stream, an explicit index takes precedence over -quality
+	var selectedVideo *Stream
+	if len(playlist.Video) == 0 {
+		if opts.VideoIndex != -1 {
+			return nil, errors.New("-video-index given but the playlist has no video streams")
+		}
+	} else if opts.VideoIndex != -1 {
+		selectedVideo, err = streamAtIndex(playlist.Video, opts.VideoIndex)
+		if err != nil {
+			return nil, fmt.Errorf("-video-index %w", err)
+		}
+	} else if opts.MaxBitrate > 0 {
+		selectedVideo = selectByMaxBitrate(playlist.Video, opts.MaxBitrate)
+	} else if opts.TargetBitrate > 0 {
+		selectedVideo = selectByTargetBitrate(playlist.Video, opts.TargetBitrate)
+	} else {
+		selectedVideo = selectVideoStream(playlist.Video, opts.VideoQuality)
+	}
+	if opts.Codec != "" && opts.VideoIndex == -1 {
+		preference, err := parseCodecPreference(opts.Codec)
+		if err != nil {
+			return nil, err
+		}
+		if selectedVideo != nil {
+			selectedVideo = preferCodec(playlist.Video, selectedVideo, preference, opts.MaxBitrate)
+		}
+	}
 
-func getBaseURLPrefix(playlistURL, relativeBase string) string {
-	// Parse the playlist URL
-	u, err := url.Parse(playlistURL)
-	if err != nil {
-		return ""
+	// Select audio stream, best unless an index was given
+	var selectedAudio *Stream
+	if len(playlist.Audio) == 0 {
+		if opts.AudioIndex != -1 {
+			return nil, errors.New("-audio-index given but the playlist has no audio streams")
+		}
+	} else if opts.AudioIndex != -1 {
+		selectedAudio, err = streamAtIndex(playlist.Audio, opts.AudioIndex)
+		if err != nil {
+			return nil, fmt.Errorf("-audio-index %w", err)
+		}
+	} else {
+		selectedAudio = &playlist.Audio[0]
 	}
 
-	// Get the directory of the playlist
-	dir := filepath.Dir(u.Path)
+	// Position of the selected video among the renditions, lower ones
+	// follow it and are fallen back to when it fails
+	videoRank := -1
+	for i := range playlist.Video {
+		if &playlist.Video[i] == selectedVideo {
+			videoRank = i
+		}
+	}
+	audioRank := -1
+	for i := range playlist.Audio {
+		if &playlist.Audio[i] == selectedAudio {
+			audioRank = i
+		}
+	}
 
-	// Apply the relative base URL (e.g., "../../../../../range/prot/")
-	parts := strings.Split(relativeBase, "/")
-	for _, part := range parts {
-		if part == ".." {
-			dir = filepath.Dir(dir)
-		} else if part != "" && part != "." {
-			dir = filepath.Join(dir, part)
+	if opts.VerifyTimeline {
+		if selectedVideo, err = verifyTimeline(VideoStream, selectedVideo, opts.Strict); err != nil {
+			return nil, err
+		}
+		if selectedAudio, err = verifyTimeline(AudioStream, selectedAudio, opts.Strict); err != nil {
+			return nil, err
 		}
 	}
 
-	// Reconstruct the full URL
-	u.Path = dir + "/"
-	u.RawQuery = "" // Remove query params, they'll be in segment URLs
-	return u.String()
-}
+	// The first selected stream, which sets the timeline of the output
+	primary := selectedVideo
+	if primary == nil {
+		primary = selectedAudio
+	}
 
-func fetchURL(urlStr string) ([]byte, error) {
-	req, err := http.NewRequest("GET", urlStr, nil)
+	// Restrict both streams to the segments overlapping -start/-end
+	timeRange, err := parseTimeRange(opts.StartTime, opts.EndTime)
 	if err != nil {
 		return nil, err
 	}
+	var trimRange *TimeRange
+	if timeRange != nil {
+		if selectedVideo != nil {
+			if selectedVideo, err = clipStream(selectedVideo, timeRange); err != nil {
+				return nil, fmt.Errorf("video %w", err)
+			}
+			primary = selectedVideo
+		}
+		if selectedAudio != nil {
+			if selectedAudio, err = clipStream(selectedAudio, timeRange); err != nil {
+				return nil, fmt.Errorf("audio %w", err)
+			}
+			if selectedVideo == nil {
+				primary = selectedAudio
+			}
+		}
+		if opts.Trim {
+			trimRange = trimRelativeTo(primary, timeRange)
+		}
+		infof("\nTime range: %d video and %d audio segments", segmentCount(selectedVideo), segmentCount(selectedAudio))
+	}
 
-	for key, value := range defaultHeaders {
-		req.Header.Set(key, value)
+	infof("")
+	if selectedVideo != nil {
+		infof("Selected video: %dx%d @ %d kbps", selectedVideo.Width, selectedVideo.Height, selectedVideo.Bitrate/1000)
+	}
+	if selectedAudio != nil {
+		infof("Selected audio: %d kbps", selectedAudio.Bitrate/1000)
 	}
 
-	resp, err := httpClient.Do(req)
-	if err != nil {
+	// A broken init segment would only show when muxing, after the whole
+	// download
+	if err := checkStreamInit(VideoStream, selectedVideo); err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+	if err := checkStreamInit(AudioStream, selectedAudio); err != nil {
+		return nil, err
 	}
 
-	return io.ReadAll(resp.Body)
-}
+	// Estimate the download size from the playlist's segment sizes
+	estimatedSize := estimateStreamSize(selectedVideo) + estimateStreamSize(selectedAudio)
+	if estimatedSize > 0 {
+		infof("Estimated size: %s", formatSize(estimatedSize))
+	} else {
+		infof("Estimated size: unknown")
+	}
 
-func downloadStreamSegments(stream *Stream, baseURLPrefix, outputFile string, concurrent int, completedCounter *int64) error {
-	// Write init segment first (it's base64 encoded)
+	// Without a name from -o or the batch file, -output-template names the
+	// output after the selected streams
+	templated := opts.OutputFile == "" && opts.OutputTemplate != ""
+	if templated {
+		index := videoRank
+		if selectedVideo == nil {
+			index = audioRank
+		}
+		opts.OutputFile, err = expandOutputTemplate(opts.OutputTemplate, playlist.ClipID, index, selectedVideo, selectedAudio)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Resolve the output container from -format, the -o extension, or the
+	// codecs
+	container, err := resolveContainer(opts.Format, opts.OutputFile, selectedVideo, selectedAudio)
+	if err != nil {
+		return nil, err
+	}
+	if templated {
+		if filepath.Ext(opts.OutputFile) == "" {
+			opts.OutputFile += "." + container.Name
+		}
+		infof("Output: %s", opts.OutputFile)
+	}
+	if opts.OutputFile == "" {
+		videoTitle := opts.Title
+		if videoTitle == "" && config != nil {
+			videoTitle = config.Video.Title
+		}
+		opts.OutputFile = defaultOutputBase(videoTitle, playlist.ClipID) + "." + container.Name
+		infof("Output: %s", opts.OutputFile)
+	}
+	warnCodecCompatibility(container, selectedVideo, selectedAudio)
+	if opts.FastStart && container.Muxer != "mp4" && container.Muxer != "mov" {
+		warnf("-faststart only applies to MP4 and MOV outputs, ignoring it for %s", container.Name)
+	}
+
+	// With -skip-mux the tracks are written straight to their final names
+	outputBase := strings.TrimSuffix(opts.OutputFile, filepath.Ext(opts.OutputFile))
+	if opts.SkipMux {
+		if selectedVideo != nil {
+			outputs = append(outputs, outputBase+".video.mp4")
+		}
+		if selectedAudio != nil {
+			outputs = append(outputs, outputBase+".audio.m4a")
+		}
+	} else if !toStdout {
+		outputs = append(outputs, opts.OutputFile)
+	}
+	remoteOutput := ""
+	if isRemoteOutput(opts.OutputFile) {
+		if opts.SkipMux {
+			return nil, fmt.Errorf("-skip-mux writes local files and can't be used with -o %s", opts.OutputFile)
+		}
+		remoteOutput = opts.OutputFile
+	}
+
+	metadata := resolveMetadata(opts.Title, opts.Artist, opts.Comment, config, &playlist, opts.PlaylistURL)
+
+	thumbnailURL := opts.Thumbnail
+	if thumbnailURL == "" && config != nil {
+		thumbnailURL = config.ThumbnailURL()
+	}
+	if toStdout {
+		// A failed cover art attempt can't be retried once ffmpeg has
+		// started writing to the pipe, and there's nowhere for a sidecar
+		thumbnailURL = ""
+	}
+
+	if opts.CheckURLs {
+		return nil, downloader.CheckURLs(selectedVideo, selectedAudio, baseURLPrefix)
+	}
+	if opts.DryRun {
+		return nil, printDryRun(dryRunPlan(opts, src, selectedVideo, selectedAudio, estimatedSize, container, outputs, metadata, thumbnailURL, trimRange))
+	}
+
+	// A template may name directories that don't exist yet
+	if templated {
+		if err := os.MkdirAll(filepath.Dir(opts.OutputFile), 0755); err != nil {
+			return nil, fmt.Errorf("creating output directory: %w", err)
+		}
+	}
+
+	// Settle overwriting before downloading so no bandwidth is wasted
+	for _, output := range outputs {
+		if isRemoteOutput(output) {
+			continue
+		}
+		if err := confirmOverwrite(output, opts.Overwrite, opts.NoOverwrite); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.TempDir != "" {
+		if err := os.MkdirAll(opts.TempDir, 0755); err != nil {
+			return nil, fmt.Errorf("creating temp directory: %w", err)
+		}
+	} else {
+		opts.TempDir = os.TempDir()
+	}
+
+	// The streams and the muxed copy of them live side by side until the
+	// temp directory is removed, so both need to fit. Unmuxed streams are
+	// written once, next to the output.
+	spaceDir, spaceNeeded := opts.TempDir, 2*estimatedSize
+	if opts.SkipMux {
+		spaceDir, spaceNeeded = filepath.Dir(opts.OutputFile), estimatedSize
+	} else if toStdout {
+		spaceNeeded = estimatedSize
+	}
+	if maxSize := downloader.MaxSize; !opts.Force && maxSize > 0 && estimatedSize > maxSize {
+		return nil, fmt.Errorf("estimated size %s exceeds -max-size %s (use -force to start anyway)", formatSize(estimatedSize), formatSize(maxSize))
+	}
+	if !opts.Force && estimatedSize > 0 {
+		if err := checkDiskSpace(spaceDir, spaceNeeded); err != nil {
+			return nil, fmt.Errorf("%w (use -force to download anyway)", err)
+		}
+	}
+
+	// Create temp directory
+	tempDir, err := os.MkdirTemp(opts.TempDir, "vimeo-download-*")
+	if err != nil {
+		return nil, fmt.Errorf("creating temp directory: %w", err)
+	}
+	removeTemp := !opts.KeepTemp
+	if opts.KeepTemp {
+		// Printed up front so the path is known even if a later step fails
+		infof("Keeping temp files in: %s", tempDir)
+	}
+	defer func() {
+		if removeTemp {
+			os.RemoveAll(tempDir)
+		}
+	}()
+
+	// A remote output is made next to the streams, then uploaded
+	if remoteOutput != "" {
+		opts.OutputFile = filepath.Join(tempDir, "output"+filepath.Ext(remoteOutput))
+		outputs = []string{opts.OutputFile}
+	}
+
+	videoFile := filepath.Join(tempDir, "video.mp4")
+	audioFile := filepath.Join(tempDir, "audio.mp4")
+	if opts.SkipMux {
+		videoFile = outputBase + ".video.mp4"
+		audioFile = outputBase + ".audio.m4a"
+	}
+
+	// The renditions of -all-qualities share one audio download, the first
+	// one to get it keeps it outside its temp directory for the others
+	shared := opts.sharedAudio
+	reuseAudio := shared != nil && shared.file != "" && selectedAudio != nil
+	downloadAudio := selectedAudio
+	if reuseAudio {
+		downloadAudio = nil
+		if opts.SkipMux {
+			if err := copyFile(shared.file, audioFile); err != nil {
+				return nil, fmt.Errorf("copying audio: %w", err)
+			}
+		} else {
+			audioFile = shared.file
+		}
+	} else if shared != nil && selectedAudio != nil && !opts.SkipMux {
+		if shared.dir == "" {
+			if shared.dir, err = os.MkdirTemp(opts.TempDir, "vimeo-audio-*"); err != nil {
+				return nil, fmt.Errorf("creating temp directory: %w", err)
+			}
+			if opts.KeepTemp {
+				infof("Keeping the shared audio in: %s", shared.dir)
+			}
+		}
+		audioFile = filepath.Join(shared.dir, "audio.mp4")
+	}
+
+	// Download video and audio streams IN PARALLEL
+	var kinds []StreamKind
+	switch {
+	case reuseAudio:
+		infof("\nDownloading video, the audio was downloaded with an earlier rendition...")
+		kinds = []StreamKind{VideoStream}
+	case selectedVideo != nil && selectedAudio != nil:
+		infof("\nDownloading video and audio in parallel...")
+		kinds = []StreamKind{VideoStream, AudioStream}
+	case selectedVideo != nil:
+		infof("\nDownloading video...")
+		kinds = []StreamKind{VideoStream}
+	default:
+		infof("\nDownloading audio...")
+		kinds = []StreamKind{AudioStream}
+	}
+
+	// With -skip-mux the streams are downloaded straight to the outputs,
+	// which a failed download mustn't leave behind half written
+	downloadFailed := func(err error) ([]string, error) {
+		if opts.SkipMux {
+			for _, output := range outputs {
+				os.Remove(output)
+			}
+		}
+		return nil, err
+	}
+
+	// The progress display is redrawn in place on a terminal, and printed
+	// now and then otherwise. JSON progress is meant for programs and always
+	// written.
+	progressOut := os.Stdout
+	if toStdout {
+		progressOut = os.Stderr
+	}
+	progressBar := opts.Progress == ProgressBar && !opts.Quiet
+	liveProgress := progressBar && isTerminal(progressOut) && opts.batchProgress == nil
+	var jsonProgressOut io.Writer = os.Stderr
+	if opts.Progress == ProgressJSON && opts.ProgressFile != "" {
+		f, err := os.OpenFile(opts.ProgressFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("opening progress file: %w", err)
+		}
+		defer f.Close()
+		jsonProgressOut = f
+	}
+	newProgress := func(kinds ...StreamKind) ProgressFunc {
+		switch {
+		case progressBar && opts.batchProgress != nil:
+			return opts.batchProgress.track(opts.batchIndex, opts.OutputFile, kinds...)
+		case progressBar:
+			return newConsoleProgress(progressOut, kinds...)
+		case opts.Progress == ProgressJSON:
+			return newJSONProgress(jsonProgressOut, kinds...)
+		}
+		return nil
+	}
+
+	var manifest *manifestRecorder
+	if opts.ManifestFile != "" {
+		manifest = &manifestRecorder{}
+		downloader.SegmentFunc = manifest.record
+	}
+	var archive *segmentArchive
+	if opts.SaveSegments != "" {
+		archive = &segmentArchive{dir: opts.SaveSegments}
+		if err := archive.use(VideoStream, selectedVideo); err != nil {
+			return nil, err
+		}
+		if err := archive.use(AudioStream, downloadAudio); err != nil {
+			return nil, err
+		}
+		record := downloader.SegmentFunc
+		downloader.SegmentFunc = func(stream StreamKind, index int, url string, data []byte) {
+			if record != nil {
+				record(stream, index, url, data)
+			}
+			archive.save(stream, index, data)
+		}
+	}
+
+	downloader.ProgressFunc = newProgress(kinds...)
+	videoErr, audioErr := downloader.Download(selectedVideo, downloadAudio, baseURLPrefix, videoFile, audioFile)
+	if liveProgress {
+		fmt.Fprintln(progressOut) // New line after progress
+	}
+	if reuseAudio && manifest != nil {
+		manifest.restore(AudioStream, shared.segments)
+	}
+
+	// A rendition whose segments keep failing, e.g. because the token is
+	// scoped to another rendition, may still work in a lower quality. The
+	// audio is kept, only the video is downloaded again.
+	for fallbacks := 0; videoErr != nil && audioErr == nil && !errors.Is(videoErr, ErrMaxSizeExceeded) && !opts.NoFallback && fallbacks < opts.MaxFallbacks; fallbacks++ {
+		videoRank++
+		if videoRank <= 0 || videoRank >= len(playlist.Video) {
+			break
+		}
+		fallback := &playlist.Video[videoRank]
+		if err := checkStreamInit(VideoStream, fallback); err != nil {
+			warnf("skipping video %dx%d as a fallback: %v", fallback.Width, fallback.Height, err)
+			continue
+		}
+		if opts.VerifyTimeline {
+			if fallback, err = verifyTimeline(VideoStream, fallback, opts.Strict); err != nil {
+				break
+			}
+		}
+		if timeRange != nil {
+			if fallback, err = clipStream(fallback, timeRange); err != nil {
+				break
+			}
+			if opts.Trim {
+				trimRange = trimRelativeTo(fallback, timeRange)
+			}
+		}
+		warnf("video %dx%d failed (%v), falling back to %dx%d @ %d kbps",
+			selectedVideo.Width, selectedVideo.Height, videoErr, fallback.Width, fallback.Height, fallback.Bitrate/1000)
+		selectedVideo = fallback
+		downloader.ProgressFunc = newProgress(VideoStream)
+		if manifest != nil {
+			manifest.reset(VideoStream)
+		}
+		if archive != nil {
+			if err := archive.use(VideoStream, selectedVideo); err != nil {
+				return downloadFailed(err)
+			}
+		}
+		videoErr, _ = downloader.Download(selectedVideo, nil, baseURLPrefix, videoFile, audioFile)
+		if liveProgress {
+			fmt.Fprintln(progressOut)
+		}
+	}
+
+	// Unmuxed audio is an output of its own, only shared once it stays
+	if shared != nil && downloadAudio != nil && audioErr == nil && (videoErr == nil || !opts.SkipMux) {
+		shared.file = audioFile
+		if manifest != nil {
+			shared.segments = manifest.manifest(nil).Audio
+		}
+	}
+	if videoErr != nil {
+		return downloadFailed(fmt.Errorf("downloading video: %w", videoErr))
+	}
+	if audioErr != nil {
+		return downloadFailed(fmt.Errorf("downloading audio: %w", audioErr))
+	}
+	if archive != nil {
+		if err := archive.failed(); err != nil {
+			return downloadFailed(err)
+		}
+		infof("Segments saved to: %s", opts.SaveSegments)
+	}
+	for _, kind := range kinds {
+		if missing := downloader.missing[kind]; len(missing) > 0 {
+			warnf("%s: %d segments failed and were left out (-allow-missing): %v", kind, len(missing), missing)
+		}
+	}
+
+	// What follows is local work, apart from the small thumbnail and
+	// subtitle requests, so a batch can hand it to a mux worker and move on
+	// to downloading the next video
+	finish := func() ([]string, error) {
+		var err error
+
+		// Fetch the cover art, a missing thumbnail shouldn't fail the download
+		var thumbnailData []byte
+		thumbnailFile := filepath.Join(tempDir, "thumbnail.jpg")
+		if thumbnailURL != "" {
+			thumbnailData, err = downloader.fetchURL(thumbnailURL)
+			if err == nil {
+				err = os.WriteFile(thumbnailFile, thumbnailData, 0644)
+			}
+			if err != nil {
+				warnf("could not fetch thumbnail: %v", err)
+				thumbnailData = nil
+			}
+		}
+
+		// Subtitles come from the player config
+		var subtitles []Subtitle
+		if opts.Subs || opts.SubsLang != "" {
+			subtitles = fetchSubtitles(downloader, src, opts.SubsLang)
+		}
+
+		var sidecarThumbnail bool
+		sidecarSubtitles := len(subtitles) > 0
+		if opts.SkipMux {
+			infof("")
+			resultf("Skipping mux, streams saved to:")
+			for _, output := range outputs {
+				resultf("  %s", output)
+			}
+			sidecarThumbnail = thumbnailData != nil
+		} else if selectedVideo == nil || selectedAudio == nil {
+			// A single track needs no muxing, it is already a playable file
+			trackFile := videoFile
+			if selectedVideo == nil {
+				trackFile = audioFile
+			}
+			if toStdout {
+				err = copyToStdout(trackFile)
+			} else {
+				err = moveFile(trackFile, opts.OutputFile)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("writing output: %w", err)
+			}
+			sidecarThumbnail = thumbnailData != nil
+		} else {
+			// Mux video and audio with ffmpeg
+			outputName := opts.OutputFile
+			if toStdout {
+				outputName = "stdout"
+			}
+			infof("\nMuxing with ffmpeg to %s...", outputName)
+			muxOpts := MuxOptions{
+				Container: container,
+				Metadata:  metadata,
+				Trim:      trimRange,
+				FastStart: opts.FastStart,
+			}
+			sidecarThumbnail = thumbnailData != nil && !container.CoverArt
+			if thumbnailData != nil && container.CoverArt {
+				muxOpts.Thumbnail = thumbnailFile
+			}
+			// Embedded subtitles go through SubRip, which every container's
+			// subtitle encoder takes
+			for i, sub := range subtitles {
+				subFile := filepath.Join(tempDir, fmt.Sprintf("subtitles_%d.srt", i))
+				if err := os.WriteFile(subFile, vttToSRT(sub.VTT), 0644); err != nil {
+					return nil, fmt.Errorf("writing subtitles: %w", err)
+				}
+				muxOpts.Subtitles = append(muxOpts.Subtitles, SubtitleFile{Path: subFile, Lang: sub.Track.Lang, Label: sub.Track.Label})
+			}
+			sidecarSubtitles = false
+			muxStart := time.Now()
+			err = muxStreams(videoFile, audioFile, opts.OutputFile, muxOpts)
+			if err != nil && muxOpts.Thumbnail != "" {
+				warnf("ffmpeg rejected the cover art (%v), retrying without it", err)
+				muxOpts.Thumbnail = ""
+				sidecarThumbnail = true
+				err = muxStreams(videoFile, audioFile, opts.OutputFile, muxOpts)
+			}
+			// Reencoding the audio is usually enough and keeps the video
+			// as it is, only then is everything reencoded
+			for _, mode := range []ReencodeMode{ReencodeAudio, ReencodeAll} {
+				if err == nil || opts.NoReencode || !isCopyUnsupported(err) {
+					break
+				}
+				warnf("ffmpeg can't copy the streams into %s, %s; this is slower and loses quality (-no-reencode to fail instead)", container.Name, mode)
+				logger.Debug("copy failed", "error", err)
+				muxOpts.Reencode = mode
+				err = muxStreams(videoFile, audioFile, opts.OutputFile, muxOpts)
+			}
+			downloader.Metrics.muxDone(time.Since(muxStart))
+			if err != nil {
+				return nil, fmt.Errorf("muxing: %w", err)
+			}
+		}
+
+		if sidecarThumbnail {
+			sidecar := outputBase + ".jpg"
+			if err := saveOutput(sidecar, thumbnailData, downloader.client()); err != nil {
+				warnf("could not write thumbnail: %v", err)
+			} else {
+				infof("Thumbnail saved to: %s", sidecar)
+			}
+		}
+		if sidecarSubtitles {
+			if toStdout {
+				warnf("subtitles can't be embedded in a single track written to stdout, skipping them")
+			} else {
+				writeSubtitleSidecars(outputBase, subtitles, opts.SubsFormat, downloader.client())
+			}
+		}
+
+		// Checksums are taken of the final files, after muxing
+		if opts.Checksum || manifest != nil {
+			if toStdout {
+				warnf("checksums of the output aren't available with -o -")
+			}
+			var files []ManifestFile
+			for _, output := range outputs {
+				file, err := checksumFile(output)
+				if err != nil {
+					return nil, fmt.Errorf("checksumming output: %w", err)
+				}
+				if remoteOutput != "" {
+					file.Path = remoteOutput
+				}
+				files = append(files, file)
+				if opts.Checksum {
+					resultf("SHA-256: %s  %s", file.SHA256, file.Path)
+				}
+			}
+			if manifest != nil {
+				if err := writeManifest(opts.ManifestFile, manifest.manifest(files)); err != nil {
+					return nil, fmt.Errorf("writing manifest: %w", err)
+				}
+				infof("Manifest saved to: %s", opts.ManifestFile)
+			}
+		}
+
+		if opts.SkipMux {
+			infof("")
+			resultf("Done!")
+			return outputs, nil
+		}
+		if toStdout {
+			infof("")
+			resultf("Done! Output written to stdout")
+			return nil, nil
+		}
+
+		// Only report success for a real file
+		info, err := verifyOutput(opts.OutputFile)
+		if err != nil {
+			return nil, err
+		}
+		if remoteOutput != "" {
+			infof("Uploading to %s...", remoteOutput)
+			if err := uploadOutput(opts.OutputFile, remoteOutput, downloader.client()); err != nil {
+				return nil, fmt.Errorf("uploading output: %w", err)
+			}
+			infof("")
+			resultf("Done! Output uploaded to: %s (%s)", remoteOutput, formatSize(info.Size()))
+			return []string{remoteOutput}, nil
+		}
+		infof("")
+		resultf("Done! Output saved to: %s (%s)", opts.OutputFile, formatSize(info.Size()))
+
+		return outputs, nil
+	}
+	if opts.muxQueue != nil && !toStdout {
+		removeTemp = false
+		queued = true
+		opts.muxQueue.submit(opts.batchIndex, func() error {
+			if !opts.KeepTemp {
+				defer os.RemoveAll(tempDir)
+			}
+			outputs, err := finish()
+			runExecHooks(opts, outputs, err)
+			return err
+		})
+		return outputs, nil
+	}
+	return finish()
+}
+
+// selectVideoStream picks a video stream from streams sorted highest first
+// according to quality: best, worst, or a resolution like 720 or 720p. When
+// no stream has the requested height the nearest one is used.
+func selectVideoStream(streams []Stream, quality string) *Stream {
+	switch quality {
+	case "best":
+		return &streams[0]
+	case "worst":
+		return &streams[len(streams)-1]
+	}
+
+	height, err := strconv.Atoi(strings.TrimSuffix(quality, "p"))
+	if err != nil {
+		warnf("Quality '%s' not recognized, using best", quality)
+		return &streams[0]
+	}
+
+	nearest := nearestHeight(streams, height)
+	if nearest.Height != height {
+		warnf("Quality '%s' not found, using nearest available %dp", quality, nearest.Height)
+	}
+	return nearest
+}
+
+// nearestHeight returns the stream whose height is closest to height,
+// preferring the lower resolution when two are equally close
+func nearestHeight(streams []Stream, height int) *Stream {
+	var best *Stream
+	bestDiff := 0
+	for i := range streams {
+		v := &streams[i]
+		diff := v.Height - height
+		if diff < 0 {
+			diff = -diff
+		}
+		if best == nil || diff < bestDiff || (diff == bestDiff && v.Height < best.Height) {
+			best, bestDiff = v, diff
+		}
+	}
+	return best
+}
+
+// streamBitrate returns the stream's peak bitrate in bps, falling back to
+// the average when the playlist doesn't provide one
+func streamBitrate(s *Stream) int {
+	if s.Bitrate > 0 {
+		return s.Bitrate
+	}
+	return s.AvgBitrate
+}
+
+// warnIgnoredSelection warns when a -quality that was given is replaced by
+// a bitrate selection rather than narrowed by it, and when -max-bitrate
+// replaces -target-bitrate. -video-index is documented to override them all.
+func warnIgnoredSelection(opts Options) {
+	if opts.VideoIndex != -1 {
+		return
+	}
+	var selectedBy string
+	switch {
+	case opts.MaxBitrate > 0:
+		selectedBy = "-max-bitrate"
+		if opts.TargetBitrate > 0 {
+			warnf("-max-bitrate selects the video, -target-bitrate is ignored")
+		}
+	case opts.TargetBitrate > 0:
+		selectedBy = "-target-bitrate"
+	}
+	if selectedBy != "" && opts.VideoQuality != "best" {
+		warnf("%s selects the video, -quality %s is ignored", selectedBy, opts.VideoQuality)
+	}
+}
+
+// selectByMaxBitrate picks the highest resolution stream whose bitrate is at
+// or below maxKbps. When none qualifies it warns and returns the stream with
+// the lowest bitrate. streams must be sorted highest resolution first.
+func selectByMaxBitrate(streams []Stream, maxKbps int) *Stream {
+	if len(streams) == 0 {
+		return nil
+	}
+
+	for i := range streams {
+		if streamBitrate(&streams[i]) <= maxKbps*1000 {
+			return &streams[i]
+		}
+	}
+
+	lowest := &streams[0]
+	for i := range streams {
+		if streamBitrate(&streams[i]) < streamBitrate(lowest) {
+			lowest = &streams[i]
+		}
+	}
+	warnf("No stream at or below %d kbps, using lowest bitrate (%d kbps)",
+		maxKbps, streamBitrate(lowest)/1000)
+	return lowest
+}
+
+// selectByTargetBitrate picks the stream whose bitrate is closest to
+// targetKbps, preferring the earlier (higher resolution) stream on ties
+func selectByTargetBitrate(streams []Stream, targetKbps int) *Stream {
+	var best *Stream
+	bestDiff := 0
+	for i := range streams {
+		diff := streamBitrate(&streams[i]) - targetKbps*1000
+		if diff < 0 {
+			diff = -diff
+		}
+		if best == nil || diff < bestDiff {
+			best, bestDiff = &streams[i], diff
+		}
+	}
+	return best
+}
+
+// codecNames maps the names -codec takes to the codec string prefixes of
+// the playlist
+var codecNames = map[string][]string{
+	"av1":  {"av01"},
+	"hevc": {"hvc1", "hev1"},
+	"h265": {"hvc1", "hev1"},
+	"h264": {"avc1", "avc3"},
+	"avc":  {"avc1", "avc3"},
+	"vp9":  {"vp09", "vp9"},
+	"vp8":  {"vp8"},
+}
+
+// parseCodecPreference parses a -codec list like av1,hevc,h264 into the
+// codec prefixes of each entry, most preferred first
+func parseCodecPreference(list string) ([][]string, error) {
+	var preference [][]string
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		prefixes, ok := codecNames[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown codec %q in -codec (use av1, hevc, h264, vp9, or vp8)", name)
+		}
+		preference = append(preference, prefixes)
+	}
+	return preference, nil
+}
+
+// preferCodec returns the stream with the resolution of selected whose
+// codec comes first in preference, or selected when none has a preferred
+// codec. With maxKbps, streams above that bitrate aren't considered.
+func preferCodec(streams []Stream, selected *Stream, preference [][]string, maxKbps int) *Stream {
+	for _, prefixes := range preference {
+		if hasCodecPrefix(selected.Codecs, prefixes) {
+			return selected
+		}
+		for i := range streams {
+			s := &streams[i]
+			if s.Width != selected.Width || s.Height != selected.Height || !hasCodecPrefix(s.Codecs, prefixes) {
+				continue
+			}
+			if maxKbps > 0 && streamBitrate(s) > maxKbps*1000 {
+				continue
+			}
+			return s
+		}
+	}
+	return selected
+}
+
+// segmentCount returns the number of segments in stream, 0 if it is nil
+func segmentCount(stream *Stream) int {
+	if stream == nil {
+		return 0
+	}
+	return len(stream.Segments)
+}
+
+// streamAtIndex returns streams[index], validating it against the bounds
+func streamAtIndex(streams []Stream, index int) (*Stream, error) {
+	if index < 0 || index >= len(streams) {
+		return nil, fmt.Errorf("%d out of range, %d streams available (0-%d)", index, len(streams), len(streams)-1)
+	}
+	return &streams[index], nil
+}
+
+// estimateStreamSize sums the playlist's segment sizes for a stream, which
+// is 0 when the playlist doesn't record them
+func estimateStreamSize(stream *Stream) int64 {
+	if stream == nil {
+		return 0
+	}
+	var size int64
+	for _, seg := range stream.Segments {
+		size += int64(seg.Size)
+	}
+	if size == 0 {
+		return 0
+	}
+	return size + int64(base64.StdEncoding.DecodedLen(len(stream.InitSegment)))
+}
+
+// checkDiskSpace fails when dir's filesystem has less than required bytes
+// plus a 5% margin free. Platforms without free space support are skipped.
+func checkDiskSpace(dir string, required int64) error {
+	free, err := freeDiskSpace(dir)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("checking free space in %s: %w", dir, err)
+	}
+	required += required / 20
+	if free < uint64(required) {
+		return fmt.Errorf("not enough disk space in %s: need %s, %s free",
+			dir, formatSize(required), formatSize(int64(free)))
+	}
+	return nil
+}
+
+func formatSize(bytes int64) string {
+	return fmt.Sprintf("%.2f MB", float64(bytes)/(1024*1024))
+}
+
+// ErrMaxSizeExceeded is returned by a download that went past -max-size
+var ErrMaxSizeExceeded = errors.New("download exceeded -max-size")
+
+// parseByteSize parses a size like 500M, 1.5G, or 1048576, with binary K,
+// M, G, and T suffixes to match formatSize. An empty size is 0.
+func parseByteSize(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	number := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(s), "B"), "I")
+	multiplier := 1.0
+	if n := len(number); n > 0 {
+		if i := strings.IndexByte("KMGT", number[n-1]); i >= 0 {
+			multiplier = math.Pow(1024, float64(i+1))
+			number = number[:n-1]
+		}
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value <= 0 || math.IsInf(value, 0) {
+		return 0, fmt.Errorf("%q is not a size like 500M or 2G", s)
+	}
+	return int64(value * multiplier), nil
+}
+
+// StreamList is the -list -json document describing a playlist's streams
+type StreamList struct {
+	ClipID     string       `json:"clip_id"`
+	Video      []StreamInfo `json:"video"`
+	Audio      []StreamInfo `json:"audio"`
+	TextTracks []TextTrack  `json:"text_tracks,omitempty"`
+}
+
+// StreamInfo summarizes one stream; Index matches the -list text output
+type StreamInfo struct {
+	Index     int     `json:"index"`
+	ID        string  `json:"id"`
+	Width     int     `json:"width,omitempty"`
+	Height    int     `json:"height,omitempty"`
+	Bitrate   int     `json:"bitrate"`
+	Codecs    string  `json:"codecs"`
+	Framerate float64 `json:"framerate,omitempty"`
+	Duration  float64 `json:"duration"`
+	Segments  int     `json:"segments"`
+}
+
+func newStreamInfos(streams []Stream) []StreamInfo {
+	infos := make([]StreamInfo, len(streams))
+	for i, s := range streams {
+		infos[i] = StreamInfo{
+			Index:     i,
+			ID:        s.ID,
+			Width:     s.Width,
+			Height:    s.Height,
+			Bitrate:   s.Bitrate,
+			Codecs:    s.Codecs,
+			Framerate: s.Framerate,
+			Duration:  s.Duration,
+			Segments:  len(s.Segments),
+		}
+	}
+	return infos
+}
+
+func writeStreamListJSON(w io.Writer, playlist *Playlist, tracks []TextTrack) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(StreamList{
+		ClipID:     playlist.ClipID,
+		Video:      newStreamInfos(playlist.Video),
+		Audio:      newStreamInfos(playlist.Audio),
+		TextTracks: tracks,
+	})
+}
+
+// listCodec formats a stream's codec for the -list output, which leaves it
+// out when the playlist doesn't say
+func listCodec(codecs string) string {
+	if codecs == "" {
+		return ""
+	}
+	return codecs + ", "
+}
+
+func getBaseURLPrefix(playlistURL, relativeBase string) string {
+	// Parse the playlist URL
+	u, err := url.Parse(playlistURL)
+	if err != nil {
+		return ""
+	}
+
+	// Get the directory of the playlist. URL paths always use forward
+	// slashes, so this is path rather than filepath, which would produce
+	// backslashes on Windows.
+	dir := path.Dir(u.Path)
+
+	// Apply the relative base URL (e.g., "../../../../../range/prot/")
+	parts := strings.Split(relativeBase, "/")
+	for _, part := range parts {
+		if part == ".." {
+			dir = path.Dir(dir)
+		} else if part != "" && part != "." {
+			dir = path.Join(dir, part)
+		}
+	}
+
+	// Reconstruct the full URL
+	u.Path = strings.TrimSuffix(dir, "/") + "/"
+	u.RawQuery = "" // Remove query params, they'll be in segment URLs
+	return u.String()
+}
+
+// segmentQuery returns the query string of playlistURL when segment URLs
+// lack one of their own, in which case the CDN expects the playlist's token
+// on them too. It returns "" when every segment is self-contained or the
+// playlist URL has no query.
+func segmentQuery(playlistURL string, playlist *Playlist) string {
+	u, err := url.Parse(playlistURL)
+	if err != nil || u.RawQuery == "" || !segmentsLackQuery(playlist) {
+		return ""
+	}
+	return u.RawQuery
+}
+
+// segmentsLackQuery reports whether any segment URL of playlist has no
+// query string of its own
+func segmentsLackQuery(playlist *Playlist) bool {
+	for _, streams := range [][]Stream{playlist.Video, playlist.Audio} {
+		for _, s := range streams {
+			for _, seg := range s.Segments {
+				if !strings.Contains(s.BaseURL+seg.URL, "?") {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// withQuery appends query to urlStr unless it is empty or urlStr already
+// has a query string
+func withQuery(urlStr, query string) string {
+	if query == "" || strings.Contains(urlStr, "?") {
+		return urlStr
+	}
+	return urlStr + "?" + query
+}
+
+// newHeaders returns a copy of defaultHeaders with the User-Agent replaced
+// by userAgent when it is set
+func newHeaders(userAgent string) map[string]string {
+	headers := make(map[string]string, len(defaultHeaders))
+	for key, value := range defaultHeaders {
+		headers[key] = value
+	}
+	if userAgent != "" {
+		headers["User-Agent"] = userAgent
+	}
+	return headers
+}
+
+// client returns the HTTP client requests are made with
+func (d *Downloader) client() *http.Client {
+	if d.Client != nil {
+		return d.Client
+	}
+	if d.Session != nil {
+		return d.Session.client
+	}
+	return httpClient
+}
+
+// setHeaders applies the downloader's headers to req
+func (d *Downloader) setHeaders(req *http.Request) {
+	headers := d.Headers
+	if headers == nil {
+		headers = defaultHeaders
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+}
+
+// newTLSConfig returns the TLS settings for -insecure and -ca-cert, or nil
+// when neither is set so the secure defaults are kept
+func newTLSConfig(insecure bool, caCertFile string) (*tls.Config, error) {
+	if !insecure && caCertFile == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{}
+	if caCertFile != "" {
+		pem, err := os.ReadFile(caCertFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA certificate: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates found in %s", caCertFile)
+		}
+		config.RootCAs = pool
+	}
+	if insecure {
+		warnf("-insecure: TLS certificates are NOT verified, anyone on the network path can read and alter the traffic")
+		config.InsecureSkipVerify = true
+	}
+	return config, nil
+}
+
+// retryDelay is the linear backoff before the given retry
+func retryDelay(retry int) time.Duration {
+	return time.Duration(retry) * 500 * time.Millisecond
+}
+
+// fetchWithRetry is fetchResolved retried with backoff, for requests that
+// the whole run depends on. Permanent failures like a 404 are returned at
+// once.
+func (d *Downloader) fetchWithRetry(urlStr string) (data []byte, finalURL string, err error) {
+	for attempt := 0; attempt <= d.MaxRetries; attempt++ {
+		if attempt > 0 {
+			d.Metrics.retry()
+			time.Sleep(retryDelay(attempt))
+		}
+		data, finalURL, err = d.fetchResolved(urlStr)
+		if err == nil || !isTransient(err) {
+			return data, finalURL, err
+		}
+		logger.Debug("request failed", "url", redactURL(urlStr), "attempt", attempt+1, "error", err)
+	}
+	return nil, "", err
+}
+
+// fetchURL fetches urlStr with the downloader's headers
+func (d *Downloader) fetchURL(urlStr string) ([]byte, error) {
+	data, _, err := d.fetchResolved(urlStr)
+	return data, err
+}
+
+// fetchResolved is fetchURL that also returns the URL the response came
+// from after any redirects, which relative URLs in it must be resolved
+// against
+func (d *Downloader) fetchResolved(urlStr string) ([]byte, string, error) {
+	req, err := http.NewRequest("GET", urlStr, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	d.setHeaders(req)
+
+	start := time.Now()
+	resp, err := d.client().Do(req)
+	if err != nil {
+		return nil, "", redactURLError(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		logger.Debug("GET", "url", redactURL(urlStr), "status", resp.StatusCode, "duration", time.Since(start))
+		return nil, "", newHTTPError(resp, urlStr)
+	}
+
+	finalURL := resp.Request.URL.String()
+	if finalURL != urlStr {
+		logger.Debug("redirected", "url", redactURL(urlStr), "to", redactURL(finalURL))
+	}
+	data, err := readBody(resp)
+	logger.Debug("GET", "url", redactURL(urlStr), "status", resp.StatusCode, "bytes", len(data), "duration", time.Since(start))
+	return data, finalURL, err
+}
+
+// rateMeter computes a smoothed transfer rate over a rolling time window
+type rateMeter struct {
+	window  time.Duration
+	samples []rateSample
+}
+
+type rateSample struct {
+	at    time.Time
+	bytes int64
+}
+
+// add records the cumulative byte count at the given time and returns the
+// average rate in bytes per second across the window. ok is false until
+// enough samples have been gathered to give a meaningful rate.
+func (m *rateMeter) add(at time.Time, bytes int64) (rate float64, ok bool) {
+	m.samples = append(m.samples, rateSample{at: at, bytes: bytes})
+
+	// Drop samples that fell out of the window, always keeping two
+	for len(m.samples) > 2 && at.Sub(m.samples[1].at) >= m.window {
+		m.samples = m.samples[1:]
+	}
+
+	oldest := m.samples[0]
+	elapsed := at.Sub(oldest.at)
+	if elapsed < time.Second {
+		return 0, false
+	}
+	return float64(bytes-oldest.bytes) / elapsed.Seconds(), true
+}
+
+// estimateTotalBytes extrapolates a stream's total size from the average
+// size of the segments completed so far
+func estimateTotalBytes(completed, total int, bytes int64) int64 {
+	if completed == 0 {
+		return 0
+	}
+	return bytes * int64(total) / int64(completed)
+}
+
+func formatETA(d time.Duration) string {
+	d = d.Round(time.Second)
+	h := int(d / time.Hour)
+	m := int(d % time.Hour / time.Minute)
+	sec := int(d % time.Minute / time.Second)
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", h, m, sec)
+	}
+	return fmt.Sprintf("%02d:%02d", m, sec)
+}
+
+func percent(completed, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(completed) / float64(total) * 100
+}
+
+// clampConcurrency checks -c against -max-concurrency, returning the
+// concurrency to use
+func clampConcurrency(concurrent, maxConcurrent int) (int, error) {
+	if maxConcurrent < 1 {
+		return 0, fmt.Errorf("-max-concurrency must be at least 1, got %d", maxConcurrent)
+	}
+	if concurrent < 1 {
+		return 0, fmt.Errorf("-c must be at least 1, got %d", concurrent)
+	}
+	if concurrent > maxConcurrent {
+		warnf("-c %d is above -max-concurrency %d, using %d: that many connections run out of file descriptors or get throttled rather than download faster", concurrent, maxConcurrent, maxConcurrent)
+		return maxConcurrent, nil
+	}
+	return concurrent, nil
+}
+
+// errNoConcurrency is returned by a Downloader whose Concurrent would leave
+// its requests waiting forever for a slot
+var errNoConcurrency = errors.New("downloader concurrency must be at least 1")
+
+// Download fetches the video and audio streams in parallel, writing them to
+// videoFile and audioFile, and returns the error of each stream. Either
+// stream may be nil to download only the other one.
+func (d *Downloader) Download(video, audio *Stream, baseURLPrefix, videoFile, audioFile string) (videoErr, audioErr error) {
+	if d.Concurrent < 1 {
+		if video != nil {
+			videoErr = errNoConcurrency
+		}
+		if audio != nil {
+			audioErr = errNoConcurrency
+		}
+		return videoErr, audioErr
+	}
+	var wg sync.WaitGroup
+	var progress []*streamProgress
+
+	// One semaphore caps the requests of both streams together
+	videoSem := make(chan struct{}, d.Concurrent)
+	audioSem := videoSem
+	if d.PerStream {
+		audioSem = make(chan struct{}, d.Concurrent)
+	}
+
+	// Start video download goroutine
+	if video != nil {
+		videoProgress := &streamProgress{kind: VideoStream, total: len(video.Segments)}
+		progress = append(progress, videoProgress)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			videoErr = d.downloadStreamSegments(video, baseURLPrefix, videoFile, videoProgress, videoSem)
+		}()
+	}
+
+	// Start audio download goroutine
+	if audio != nil {
+		audioProgress := &streamProgress{kind: AudioStream, total: len(audio.Segments)}
+		progress = append(progress, audioProgress)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			audioErr = d.downloadStreamSegments(audio, baseURLPrefix, audioFile, audioProgress, audioSem)
+		}()
+	}
+
+	// Progress reporter goroutine, the only caller of ProgressFunc
+	done := make(chan struct{})
+	reporterDone := make(chan struct{})
+	go func() {
+		defer close(reporterDone)
+		ticker := time.NewTicker(500 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				d.reportProgress(progress...)
+				return
+			case <-ticker.C:
+				d.reportProgress(progress...)
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(done)
+	<-reporterDone
+
+	return videoErr, audioErr
+}
+
+func (d *Downloader) reportProgress(progress ...*streamProgress) {
+	if d.ProgressFunc == nil {
+		return
+	}
+	for _, p := range progress {
+		d.ProgressFunc(p.kind, int(atomic.LoadInt64(&p.completed)), p.total, atomic.LoadInt64(&p.bytes))
+	}
+}
+
+// downloadStreamSegments downloads stream to outputFile, holding a slot of
+// sem for every request in flight
+func (d *Downloader) downloadStreamSegments(stream *Stream, baseURLPrefix, outputFile string, progress *streamProgress, sem chan struct{}) error {
+	// Write init segment first (it's base64 encoded)
 	var initData []byte
 	if stream.InitSegment != "" {
 		var err error
@@ -344,110 +2169,799 @@ func downloadStreamSegments(stream *Stream, baseURLPrefix, outputFile string, co
 		}
 	}
 
+	// Construct full URLs, byte-range segments may share the stream's URL
+	segmentURLs := streamSegmentURLs(stream, baseURLPrefix, stream.BaseURL, d.Query)
+
+	// A segment listed more than once is only fetched for its first
+	// occurrence. The key includes the range so byte-range segments of one
+	// file stay distinct.
+	duplicates := make(map[int][]int)
+	isDuplicate := make([]bool, len(stream.Segments))
+	firstIndex := make(map[string]int)
+	for i, seg := range stream.Segments {
+		key := segmentURLs[i]
+		if seg.Range != nil {
+			key += fmt.Sprintf("#%d-%d", seg.Range.Start, seg.Range.End)
+		}
+		if first, ok := firstIndex[key]; ok {
+			duplicates[first] = append(duplicates[first], i)
+			isDuplicate[i] = true
+		} else {
+			firstIndex[key] = i
+		}
+	}
+
 	// Download all segments concurrently and store in memory
 	segmentData := make([][]byte, len(stream.Segments))
-	sem := make(chan struct{}, concurrent)
 	var wg sync.WaitGroup
 	var downloadErr error
 	var errMutex sync.Mutex
+	var failed atomic.Bool
+	var missing []int
+	var expired bool // Segments were refused after others succeeded
+	urlsGeneration := 0
 
-	for i, segment := range stream.Segments {
-		wg.Add(1)
-		go func(idx int, seg Segment) {
-			defer wg.Done()
+	for {
+		for i, segment := range stream.Segments {
+			if isDuplicate[i] || segmentData[i] != nil {
+				continue
+			}
+			wg.Add(1)
+			go func(idx int, seg Segment) {
+				defer wg.Done()
 
-			sem <- struct{}{}
-			defer func() { <-sem }()
+				sem <- struct{}{}
+				defer func() { <-sem }()
+				// Shared slots are always taken second, so a download waiting
+				// for one holds no more than its own
+				if d.Slots != nil {
+					d.Slots <- struct{}{}
+					defer func() { <-d.Slots }()
+				}
+
+				// The stream is lost once a segment fails, don't waste bandwidth
+				if failed.Load() {
+					return
+				}
 
-			// Construct full URL
-			fullURL := baseURLPrefix + seg.URL
+				fullURL := segmentURLs[idx]
 
-			// Download with retry
-			var data []byte
-			var err error
-			for retries := 0; retries < 3; retries++ {
-				data, err = downloadToMemory(fullURL)
-				if err == nil {
-					break
+				// Download with retry
+				var data []byte
+				var err error
+				for attempt := 0; attempt <= d.MaxRetries; attempt++ {
+					if attempt > 0 {
+						d.Metrics.retry()
+						time.Sleep(retryDelay(attempt))
+					}
+					requestDone := d.Metrics.requestStarted()
+					data, err = d.downloadToMemory(fullURL, seg.Range)
+					requestDone()
+					if err == nil {
+						break
+					}
+					logger.Debug("segment failed", "stream", progress.kind, "segment", idx, "attempt", attempt+1, "error", err)
 				}
-				time.Sleep(time.Duration(retries+1) * 500 * time.Millisecond)
-			}
 
-			if err != nil {
-				errMutex.Lock()
-				if downloadErr == nil {
-					downloadErr = fmt.Errorf("segment %d: %w", idx, err)
+				if err != nil {
+					d.Metrics.failure()
+					errMutex.Lock()
+					defer errMutex.Unlock()
+					// Segments that worked before and are now refused point at
+					// the token in the URLs having expired
+					if isAuthFailure(err) && atomic.LoadInt64(&progress.completed) > 0 {
+						expired = true
+						failed.Store(true)
+						if downloadErr == nil {
+							downloadErr = fmt.Errorf("segment %d: %w (%v)", idx, ErrTokenExpired, err)
+						}
+						return
+					}
+					if len(missing)+1+len(duplicates[idx]) <= d.AllowMissing {
+						missing = append(missing, idx)
+						missing = append(missing, duplicates[idx]...)
+						return
+					}
+					failed.Store(true)
+					if downloadErr == nil {
+						downloadErr = fmt.Errorf("segment %d: %w", idx, err)
+						if d.AllowMissing > 0 {
+							downloadErr = fmt.Errorf("%w (more than -allow-missing %d segments failed)", downloadErr, d.AllowMissing)
+						}
+					}
+					return
 				}
-				errMutex.Unlock()
-				return
-			}
 
-			segmentData[idx] = data
-			atomic.AddInt64(completedCounter, 1)
-		}(i, segment)
-	}
+				d.Metrics.segmentDone(len(data))
+				// Both streams and any fallback count against the one limit
+				if d.downloaded.Add(int64(len(data))) > d.MaxSize && d.MaxSize > 0 {
+					errMutex.Lock()
+					defer errMutex.Unlock()
+					failed.Store(true)
+					if downloadErr == nil {
+						downloadErr = fmt.Errorf("%w of %s", ErrMaxSizeExceeded, formatSize(d.MaxSize))
+					}
+					return
+				}
+				segmentData[idx] = data
+				for _, dup := range duplicates[idx] {
+					segmentData[dup] = data
+				}
+				if d.SegmentFunc != nil {
+					d.SegmentFunc(progress.kind, idx, fullURL, data)
+					for _, dup := range duplicates[idx] {
+						d.SegmentFunc(progress.kind, dup, segmentURLs[dup], data)
+					}
+				}
+				atomic.AddInt64(&progress.bytes, int64(len(data)))
+				atomic.AddInt64(&progress.completed, int64(1+len(duplicates[idx])))
+			}(i, segment)
+		}
+		wg.Wait()
 
-	wg.Wait()
+		if !expired {
+			break
+		}
+		if d.Refresh == nil {
+			return fmt.Errorf("%w; get a fresh playlist.json URL and run again, or pass the player config URL, which is refreshed automatically", downloadErr)
+		}
+		// Fetch the playlist again and go on with the segments not downloaded
+		// yet, the other stream may have done so already
+		fresh, generation, err := d.refreshTokens(urlsGeneration)
+		if err != nil {
+			return fmt.Errorf("%w; getting fresh URLs failed: %v", downloadErr, err)
+		}
+		freshStream := findStream(fresh.playlist, progress.kind, stream.ID)
+		if freshStream == nil {
+			return fmt.Errorf("%w; the %s stream %s is missing from the fresh playlist", downloadErr, progress.kind, stream.ID)
+		}
+		infof("Resuming the %s with fresh segment URLs", progress.kind)
+		urlsGeneration = generation
+		segmentURLs = streamSegmentURLs(stream, fresh.baseURLPrefix, freshStream.BaseURL, fresh.query)
+		downloadErr, expired, missing = nil, false, nil
+		failed.Store(false)
+	}
 
+	sort.Ints(missing)
+	d.missing[progress.kind] = missing
 	if downloadErr != nil {
 		return downloadErr
 	}
+	if len(missing) > 0 && len(missing) == len(stream.Segments) {
+		return errors.New("every segment failed")
+	}
 
-	// Write everything to output file
+	// Write everything to output file, a partial one is removed
 	out, err := os.Create(outputFile)
 	if err != nil {
 		return err
 	}
-	defer out.Close()
+	if err := writeSegments(out, initData, segmentData); err != nil {
+		out.Close()
+		os.Remove(outputFile)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(outputFile)
+		return err
+	}
+	return nil
+}
+
+// streamSegmentURLs returns the URL of each segment of stream, relative to
+// baseURLPrefix and baseURL, with query added to those that have none
+func streamSegmentURLs(stream *Stream, baseURLPrefix, baseURL, query string) []string {
+	urls := make([]string, len(stream.Segments))
+	for i, seg := range stream.Segments {
+		urls[i] = withQuery(baseURLPrefix+baseURL+seg.URL, query)
+	}
+	return urls
+}
+
+// maxTokenRefreshes bounds how often the playlist is fetched again for
+// fresh URLs during one download
+const maxTokenRefreshes = 3
+
+// ErrTokenExpired is returned when segments start being refused partway
+// through a download, which is how an expired URL token shows
+var ErrTokenExpired = errors.New("segment URLs have expired")
+
+// freshPlaylist is the playlist fetched again by Refresh
+type freshPlaylist struct {
+	playlist      Playlist
+	baseURLPrefix string
+	query         string
+}
+
+// refreshTokens calls Refresh for a stream whose URLs came from the given
+// generation of playlists, or returns the newer one another stream already
+// fetched, along with its generation
+func (d *Downloader) refreshTokens(generation int) (*freshPlaylist, int, error) {
+	d.freshMu.Lock()
+	defer d.freshMu.Unlock()
+	if d.freshGeneration > generation {
+		return d.fresh, d.freshGeneration, nil
+	}
+	if d.freshGeneration >= maxTokenRefreshes {
+		return nil, generation, fmt.Errorf("still refused after %d fresh playlists", maxTokenRefreshes)
+	}
+	playlist, baseURLPrefix, query, err := d.Refresh()
+	if err != nil {
+		return nil, generation, err
+	}
+	d.freshGeneration++
+	d.fresh = &freshPlaylist{playlist: playlist, baseURLPrefix: baseURLPrefix, query: query}
+	return d.fresh, d.freshGeneration, nil
+}
+
+// findStream returns the stream of the given kind and ID in playlist, or
+// nil
+func findStream(playlist Playlist, kind StreamKind, id string) *Stream {
+	streams := playlist.Video
+	if kind == AudioStream {
+		streams = playlist.Audio
+	}
+	for i := range streams {
+		if streams[i].ID == id {
+			return &streams[i]
+		}
+	}
+	return nil
+}
+
+// refreshFromConfig fetches the player config at configURL again for a
+// playlist URL with a fresh token, then that playlist. It is the Refresh
+// of downloads from a player config.
+func (d *Downloader) refreshFromConfig(configURL, queryToken string) (Playlist, string, string, error) {
+	infof("Segment URLs expired, fetching a fresh playlist URL from the player config...")
+	data, _, err := d.fetchWithRetry(configURL)
+	if err != nil {
+		return Playlist{}, "", "", fmt.Errorf("fetching player config: %w", err)
+	}
+	config, ok := parsePlayerConfig(data)
+	if !ok {
+		return Playlist{}, "", "", errors.New("the URL no longer returns a player config")
+	}
+	playlistURL, err := config.PlaylistURL()
+	if err != nil {
+		return Playlist{}, "", "", err
+	}
+	data, resolvedURL, err := d.fetchWithRetry(playlistURL)
+	if err != nil {
+		return Playlist{}, "", "", fmt.Errorf("fetching playlist: %w", err)
+	}
+	playlist, baseURLPrefix, err := d.loadPlaylist(data, resolvedURL)
+	if err != nil {
+		return Playlist{}, "", "", err
+	}
+	query := strings.TrimPrefix(queryToken, "?")
+	if query == "" {
+		query = segmentQuery(playlistURL, &playlist)
+	}
+	return playlist, baseURLPrefix, query, nil
+}
 
-	// Write init segment
+// writeSegments writes the init segment followed by the media segments
+func writeSegments(w io.Writer, initData []byte, segmentData [][]byte) error {
 	if len(initData) > 0 {
-		if _, err := out.Write(initData); err != nil {
+		if _, err := w.Write(initData); err != nil {
 			return fmt.Errorf("failed to write init segment: %w", err)
 		}
 	}
 
 	// Write all segments in order
 	for _, data := range segmentData {
-		if _, err := out.Write(data); err != nil {
+		if _, err := w.Write(data); err != nil {
 			return fmt.Errorf("failed to write segment: %w", err)
 		}
 	}
-
 	return nil
 }
 
-func downloadToMemory(urlStr string) ([]byte, error) {
+// noteSegmentHost logs the first segment that came from host when that
+// isn't the playlist's host, e.g. after a redirect to another CDN
+func (d *Downloader) noteSegmentHost(host string) {
+	if d.playlistHost == "" || host == d.playlistHost {
+		return
+	}
+	if _, seen := d.segmentHosts.LoadOrStore(host, true); !seen {
+		infof("Segments are served from %s, not the playlist's host %s", host, d.playlistHost)
+	}
+}
+
+// hostOf returns the host of urlStr, or "" if it doesn't parse
+func hostOf(urlStr string) string {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// downloadToMemory fetches urlStr, or only byteRange of it when non-nil
+func (d *Downloader) downloadToMemory(urlStr string, byteRange *ByteRange) ([]byte, error) {
 	req, err := http.NewRequest("GET", urlStr, nil)
 	if err != nil {
 		return nil, err
 	}
-
-	for key, value := range defaultHeaders {
-		req.Header.Set(key, value)
+	d.setHeaders(req)
+	if byteRange != nil {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", byteRange.Start, byteRange.End))
 	}
 
-	resp, err := httpClient.Do(req)
+	start := time.Now()
+	resp, err := d.client().Do(req)
 	if err != nil {
-		return nil, err
+		return nil, redactURLError(err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
-		return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+		logger.Debug("GET", "url", redactURL(urlStr), "range", req.Header.Get("Range"), "status", resp.StatusCode, "duration", time.Since(start))
+		return nil, newHTTPError(resp, urlStr)
+	}
+
+	d.noteSegmentHost(resp.Request.URL.Host)
+	data, err := readBody(resp)
+	logger.Debug("GET", "url", redactURL(urlStr), "range", req.Header.Get("Range"), "status", resp.StatusCode, "bytes", len(data), "duration", time.Since(start))
+	if err != nil || byteRange == nil {
+		return data, err
+	}
+
+	// A server that ignores Range sends the whole file
+	if resp.StatusCode == http.StatusOK {
+		if int64(len(data)) <= byteRange.End {
+			return nil, fmt.Errorf("range %d-%d beyond the %d byte response", byteRange.Start, byteRange.End, len(data))
+		}
+		data = data[byteRange.Start : byteRange.End+1]
+	}
+	if int64(len(data)) != byteRange.Len() {
+		return nil, fmt.Errorf("range %d-%d returned %d bytes", byteRange.Start, byteRange.End, len(data))
+	}
+	return data, nil
+}
+
+// Container is an output container format that ffmpeg can mux into
+type Container struct {
+	Name        string   // -format value and file extension
+	Muxer       string   // ffmpeg -f muxer name
+	VideoCodecs []string // Codec prefixes that can be stream-copied, nil means any
+	AudioCodecs []string // Codec prefixes that can be stream-copied, nil means any
+	CoverArt    bool     // Supports an attached picture stream
+}
+
+var containers = map[string]Container{
+	"mp4": {
+		Name: "mp4", Muxer: "mp4",
+		VideoCodecs: []string{"avc1", "avc3", "hvc1", "hev1"},
+		AudioCodecs: []string{"mp4a", "ac-3", "ec-3", "opus", "flac"},
+		CoverArt:    true,
+	},
+	"mkv": {Name: "mkv", Muxer: "matroska", CoverArt: true},
+	"mov": {
+		Name: "mov", Muxer: "mov",
+		VideoCodecs: []string{"avc1", "avc3", "hvc1", "hev1"},
+		AudioCodecs: []string{"mp4a", "ac-3", "ec-3", "alac"},
+	},
+	"webm": {
+		Name: "webm", Muxer: "webm",
+		VideoCodecs: []string{"vp8", "vp09", "av01"},
+		AudioCodecs: []string{"opus", "vorbis"},
+	},
+}
+
+// mp4Codecs are the codecs MP4 is the natural home of. Anything else
+// (VP9, AV1, Opus) defaults to MKV, which takes every codec.
+var mp4Codecs = []string{"avc1", "avc3", "hvc1", "hev1", "mp4a", "ac-3", "ec-3"}
+
+// supports reports whether stream can be stream-copied into c. Streams
+// without codec information are assumed to fit.
+func (c Container) supports(stream *Stream) bool {
+	codecs := c.VideoCodecs
+	if strings.HasPrefix(stream.MimeType, "audio/") {
+		codecs = c.AudioCodecs
+	}
+	return codecs == nil || stream.Codecs == "" || hasCodecPrefix(stream.Codecs, codecs)
+}
+
+// hasCodecPrefix reports whether the RFC 6381 codec string starts with one
+// of prefixes
+func hasCodecPrefix(codec string, prefixes []string) bool {
+	codec = strings.ToLower(codec)
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(codec, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveContainer returns the container named by format, or the one matching
+// the output file's extension when format is empty. Otherwise it picks one
+// from the codecs of streams: MP4 for H.264/HEVC with AAC, MKV for anything
+// else such as VP9, AV1, or Opus.
+func resolveContainer(format, outputFile string, streams ...*Stream) (Container, error) {
+	if format != "" {
+		c, ok := containers[strings.ToLower(format)]
+		if !ok {
+			return Container{}, fmt.Errorf("unsupported format %q (use mp4, mkv, mov, or webm)", format)
+		}
+		return c, nil
+	}
+
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(outputFile), "."))
+	if c, ok := containers[ext]; ok {
+		return c, nil
+	}
+	for _, s := range streams {
+		if s != nil && s.Codecs != "" && !hasCodecPrefix(s.Codecs, mp4Codecs) {
+			return containers["mkv"], nil
+		}
+	}
+	return containers["mp4"], nil
+}
+
+// warnCodecCompatibility warns when a selected stream's codec can't be
+// stream-copied into the container, which makes ffmpeg fail at mux time
+func warnCodecCompatibility(c Container, streams ...*Stream) {
+	for _, s := range streams {
+		if s == nil || c.supports(s) {
+			continue
+		}
+		kind := "video"
+		if strings.HasPrefix(s.MimeType, "audio/") {
+			kind = "audio"
+		}
+		warnf("%s codec %s may not be supported in %s, consider -format mkv",
+			kind, s.Codecs, strings.ToUpper(c.Name))
+	}
+}
+
+// confirmOverwrite returns nil when outputFile may be written: it doesn't
+// exist, yes is set, or the user agrees at an interactive prompt. Without a
+// terminal to ask on it refuses rather than clobbering the file.
+func confirmOverwrite(outputFile string, yes, no bool) error {
+	if yes && no {
+		return fmt.Errorf("-y and -n are mutually exclusive")
+	}
+	if _, err := os.Stat(outputFile); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if yes {
+		return nil
+	}
+	if no {
+		return fmt.Errorf("%s already exists", outputFile)
+	}
+	if !isTerminal(os.Stdin) {
+		return fmt.Errorf("%s already exists (use -y to overwrite)", outputFile)
+	}
+
+	fmt.Printf("File %s already exists. Overwrite? [y/N] ", outputFile)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	}
+	return fmt.Errorf("not overwriting %s", outputFile)
+}
+
+// copyToStdout writes the contents of path to stdout
+func copyToStdout(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(os.Stdout, f)
+	return err
+}
+
+// moveFile moves src to dst, copying when they are on different filesystems
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	if err := copyFile(src, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// copyFile copies src to dst, leaving no partial dst behind on failure
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return nil
+}
+
+// Metadata holds the tags written into the muxed output
+type Metadata struct {
+	Title   string
+	Artist  string
+	Comment string
+}
+
+// resolveMetadata fills in unset tags from the player config when the
+// playlist was resolved through one, then from the playlist itself
+func resolveMetadata(title, artist, comment string, config *PlayerConfig, playlist *Playlist, sourceURL string) Metadata {
+	if config != nil {
+		if title == "" {
+			title = config.Video.Title
+		}
+		if artist == "" {
+			artist = config.Video.Owner.Name
+		}
+		if comment == "" {
+			comment = config.Video.URL
+		}
+	}
+	if title == "" {
+		title = playlist.ClipID
+	}
+	if comment == "" {
+		// Signed playlist URLs expire, so the token is of no use in the file
+		if u, err := url.Parse(sourceURL); err == nil {
+			u.RawQuery = ""
+			comment = u.String()
+		}
+	}
+	return Metadata{Title: title, Artist: artist, Comment: comment}
+}
+
+// MuxOptions controls how muxStreams combines the downloaded streams
+type MuxOptions struct {
+	Container Container
+	Metadata  Metadata
+	Thumbnail string         // Image file attached as cover art, optional
+	Subtitles []SubtitleFile // SubRip files embedded as subtitle streams, optional
+	Trim      *TimeRange     // Cut the output to this range, optional
+	FastStart bool           // Move the MP4/MOV index to the front for streaming
+	Reencode  ReencodeMode   // Streams to reencode instead of copy
+}
+
+// ReencodeMode is what muxStreams reencodes when the streams can't be
+// copied into the container as they are
+type ReencodeMode int
+
+const (
+	CopyStreams   ReencodeMode = iota // Copy every stream, the default
+	ReencodeAudio                     // Copy the video, reencode the audio
+	ReencodeAll                       // Reencode the video and the audio
+)
+
+func (m ReencodeMode) String() string {
+	switch m {
+	case ReencodeAudio:
+		return "reencoding the audio"
+	case ReencodeAll:
+		return "reencoding the video and audio"
+	}
+	return "copying the streams"
+}
+
+// reencodeCodecs returns the ffmpeg encoders for reencoding into c, picked
+// from the codecs every player of the container handles
+func reencodeCodecs(c Container) (video, audio string) {
+	if c.Muxer == "webm" {
+		return "libvpx-vp9", "libopus"
 	}
+	return "libx264", "aac"
+}
 
-	return io.ReadAll(resp.Body)
+// SubtitleFile is a subtitle track on disk for MuxOptions
+type SubtitleFile struct {
+	Path  string
+	Lang  string
+	Label string
 }
 
-func muxStreams(videoFile, audioFile, outputFile string) error {
-	cmd := exec.Command("ffmpeg",
+// muxArgs builds the ffmpeg argument list for muxStreams
+func muxArgs(videoFile, audioFile, outputFile string, opts MuxOptions) []string {
+	args := []string{
 		"-i", videoFile,
 		"-i", audioFile,
-		"-c", "copy",
+	}
+	if opts.Thumbnail != "" {
+		args = append(args, "-i", opts.Thumbnail)
+	}
+	for _, sub := range opts.Subtitles {
+		args = append(args, "-i", sub.Path)
+	}
+	// Extra inputs are only picked up when every stream is mapped
+	if opts.Thumbnail != "" || len(opts.Subtitles) > 0 {
+		inputs := 2 + len(opts.Subtitles)
+		if opts.Thumbnail != "" {
+			inputs++
+		}
+		for i := 0; i < inputs; i++ {
+			args = append(args, "-map", strconv.Itoa(i))
+		}
+	}
+	args = append(args, "-c", "copy")
+	videoCodec, audioCodec := reencodeCodecs(opts.Container)
+	switch opts.Reencode {
+	case ReencodeAll:
+		// Only the first video stream, a second one is the cover art
+		args = append(args, "-c:v:0", videoCodec, "-c:a", audioCodec)
+	case ReencodeAudio:
+		args = append(args, "-c:a", audioCodec)
+	}
+	if opts.Thumbnail != "" {
+		args = append(args, "-disposition:v:1", "attached_pic")
+	}
+	if len(opts.Subtitles) > 0 {
+		args = append(args, "-c:s", subtitleCodec(opts.Container))
+		for i, sub := range opts.Subtitles {
+			if sub.Lang != "" {
+				args = append(args, fmt.Sprintf("-metadata:s:s:%d", i), "language="+sub.Lang)
+			}
+			if sub.Label != "" {
+				args = append(args, fmt.Sprintf("-metadata:s:s:%d", i), "title="+sub.Label)
+			}
+		}
+	}
+	for _, tag := range []struct{ key, value string }{
+		{"title", opts.Metadata.Title},
+		{"artist", opts.Metadata.Artist},
+		{"comment", opts.Metadata.Comment},
+	} {
+		if tag.value != "" {
+			args = append(args, "-metadata", tag.key+"="+tag.value)
+		}
+	}
+	if opts.Trim != nil {
+		if opts.Trim.Start > 0 {
+			args = append(args, "-ss", strconv.FormatFloat(opts.Trim.Start, 'f', 3, 64))
+		}
+		if opts.Trim.End > 0 {
+			args = append(args, "-to", strconv.FormatFloat(opts.Trim.End, 'f', 3, 64))
+		}
+	}
+	if outputFile == stdoutOutput {
+		// A pipe can't be seeked back to write the moov atom at the end, so
+		// MP4 and MOV are written fragmented
+		if opts.Container.Muxer == "mp4" || opts.Container.Muxer == "mov" {
+			args = append(args, "-movflags", "frag_keyframe+empty_moov")
+		}
+		return append(args, "-f", opts.Container.Muxer, "pipe:1")
+	}
+	if opts.FastStart && (opts.Container.Muxer == "mp4" || opts.Container.Muxer == "mov") {
+		// ffmpeg rewrites the file once more after muxing to do this
+		args = append(args, "-movflags", "+faststart")
+	}
+	return append(args,
+		"-f", opts.Container.Muxer,
 		"-y",
 		outputFile,
 	)
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+}
+
+// muxStreams runs ffmpeg and verifies it produced a non-empty output. On
+// failure the tail of ffmpeg's log is included in the error.
+func muxStreams(videoFile, audioFile, outputFile string, opts MuxOptions) error {
+	stderr := &tailBuffer{max: 4096}
+	cmd := exec.Command("ffmpeg", muxArgs(videoFile, audioFile, outputFile, opts)...)
+	cmd.Stderr = stderr
+	var written countingWriter
+	if outputFile == stdoutOutput {
+		written.w = os.Stdout
+		cmd.Stdout = &written
+	}
+	if err := cmd.Run(); err != nil {
+		// Don't leave a truncated file that looks like a finished download
+		if outputFile != stdoutOutput {
+			os.Remove(outputFile)
+		}
+		return &ffmpegError{err: err, log: strings.TrimSpace(stderr.String())}
+	}
+	if outputFile == stdoutOutput {
+		if written.n == 0 {
+			return errors.New("ffmpeg wrote nothing to stdout")
+		}
+		return nil
+	}
+	_, err := verifyOutput(outputFile)
+	return err
+}
+
+// ffmpegError is a failed ffmpeg run with the tail of its log
+type ffmpegError struct {
+	err error
+	log string
+}
+
+func (e *ffmpegError) Error() string {
+	if e.log == "" {
+		return "ffmpeg: " + e.err.Error()
+	}
+	return "ffmpeg: " + e.err.Error() + "\n" + e.log
+}
+
+func (e *ffmpegError) Unwrap() error {
+	return e.err
+}
+
+// copyUnsupportedMessages are what ffmpeg logs when a stream's codec can't
+// be copied into the output container
+var copyUnsupportedMessages = []string{
+	"not currently supported in container",
+	"Could not find tag for codec",
+	"incompatible with output codec",
+}
+
+// isCopyUnsupported reports whether err is ffmpeg failing to copy a stream
+// into the container, which reencoding can fix. ffmpeg fails on this when
+// writing the header, before any output, so the run can be retried even
+// when writing to stdout.
+func isCopyUnsupported(err error) bool {
+	var ffErr *ffmpegError
+	if !errors.As(err, &ffErr) {
+		return false
+	}
+	for _, msg := range copyUnsupportedMessages {
+		if strings.Contains(ffErr.log, msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyOutput checks that path exists and is not empty
+func verifyOutput(path string) (os.FileInfo, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("output missing: %w", err)
+	}
+	if info.Size() == 0 {
+		return nil, fmt.Errorf("output %s is empty", path)
+	}
+	return info, nil
+}
+
+// countingWriter passes writes through to w and counts the bytes
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// tailBuffer is an io.Writer that keeps only the last max bytes written
+type tailBuffer struct {
+	max int
+	buf []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.max {
+		t.buf = t.buf[len(t.buf)-t.max:]
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	return string(t.buf)
 }
@@ -0,0 +1,1350 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// The tests check results, not what the tool prints along the way
+	setLogOutputs(io.Discard, io.Discard)
+	os.Exit(m.Run())
+}
+
+// testOptions are the flag defaults that matter to downloadFromPlaylist,
+// with the temp files in a test directory and no disk space check
+func testOptions(t *testing.T) Options {
+	return Options{
+		VideoIndex:   -1,
+		AudioIndex:   -1,
+		Progress:     ProgressNone,
+		MaxFallbacks: 2,
+		TempDir:      t.TempDir(),
+		Force:        true,
+	}
+}
+
+// fakeFFmpeg puts an ffmpeg running script first in PATH. The script gets
+// the arguments in "$@" and the output, the last of them, in $last.
+func fakeFFmpeg(t *testing.T, script string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake ffmpeg is a shell script")
+	}
+	dir := t.TempDir()
+	content := "#!/bin/sh\nfor last; do :; done\n" + script + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "ffmpeg"), []byte(content), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// testStream returns a stream of n segments named seg-<index>.m4s under
+// id/, each the size of segmentBody
+func testStream(id string, n int) Stream {
+	stream := Stream{ID: id, BaseURL: id + "/", Duration: float64(n)}
+	for i := 0; i < n; i++ {
+		stream.Segments = append(stream.Segments, Segment{
+			Start: float64(i),
+			End:   float64(i + 1),
+			URL:   fmt.Sprintf("seg-%d.m4s", i),
+			Size:  len(segmentBody(id, i)),
+		})
+	}
+	return stream
+}
+
+func segmentBody(id string, index int) string {
+	return fmt.Sprintf("[%s %d]", id, index)
+}
+
+// wantStreamFile is the file Download writes for a testStream
+func wantStreamFile(id string, n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		b.WriteString(segmentBody(id, i))
+	}
+	return b.String()
+}
+
+// segmentHandler serves the segments of testStream, with refuse deciding
+// which requests get a 403
+func segmentHandler(refuse func(r *http.Request) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if refuse != nil && refuse(r) {
+			http.Error(w, "token expired", http.StatusForbidden)
+			return
+		}
+		var id string
+		var index int
+		if _, err := fmt.Sscanf(strings.ReplaceAll(strings.TrimPrefix(r.URL.Path, "/"), "/", " "), "%s seg-%d.m4s", &id, &index); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, segmentBody(id, index))
+	})
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// expiringHandler refuses the segments of token "old" after the first
+// limit requests, and always serves those of token "new"
+func expiringHandler(limit int) http.Handler {
+	var mu sync.Mutex
+	served := 0
+	return segmentHandler(func(r *http.Request) bool {
+		if r.URL.Query().Get("t") == "new" {
+			return false
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		served++
+		return served > limit
+	})
+}
+
+func TestDownloadRefreshesExpiredURLs(t *testing.T) {
+	srv := httptest.NewServer(expiringHandler(4))
+	defer srv.Close()
+
+	video := testStream("v", 10)
+	refreshes := 0
+	d := &Downloader{
+		Concurrent: 1,
+		Query:      "t=old",
+		Refresh: func() (Playlist, string, string, error) {
+			refreshes++
+			return Playlist{Video: []Stream{testStream("v", 10)}}, srv.URL + "/", "t=new", nil
+		},
+	}
+	videoFile := filepath.Join(t.TempDir(), "video.mp4")
+	if videoErr, _ := d.Download(&video, nil, srv.URL+"/", videoFile, ""); videoErr != nil {
+		t.Fatalf("Download: %v", videoErr)
+	}
+	if refreshes != 1 {
+		t.Errorf("Refresh called %d times, want 1", refreshes)
+	}
+	if got, want := readFile(t, videoFile), wantStreamFile("v", 10); got != want {
+		t.Errorf("video file = %q, want %q", got, want)
+	}
+}
+
+func TestDownloadExpiredWithoutRefresh(t *testing.T) {
+	srv := httptest.NewServer(expiringHandler(4))
+	defer srv.Close()
+
+	video := testStream("v", 10)
+	d := &Downloader{Concurrent: 1, Query: "t=old"}
+	videoErr, _ := d.Download(&video, nil, srv.URL+"/", filepath.Join(t.TempDir(), "video.mp4"), "")
+	if !errors.Is(videoErr, ErrTokenExpired) {
+		t.Fatalf("Download: %v, want ErrTokenExpired", videoErr)
+	}
+	if !strings.Contains(videoErr.Error(), "fresh playlist.json URL") {
+		t.Errorf("error %q doesn't say to get a fresh URL", videoErr)
+	}
+}
+
+func TestDownloadExpiredAfterRefreshesFails(t *testing.T) {
+	srv := httptest.NewServer(expiringHandler(4))
+	defer srv.Close()
+
+	video := testStream("v", 10)
+	d := &Downloader{
+		Concurrent: 1,
+		Query:      "t=old",
+		// The fresh URLs carry the expired token again
+		Refresh: func() (Playlist, string, string, error) {
+			return Playlist{Video: []Stream{testStream("v", 10)}}, srv.URL + "/", "t=old", nil
+		},
+	}
+	videoErr, _ := d.Download(&video, nil, srv.URL+"/", filepath.Join(t.TempDir(), "video.mp4"), "")
+	if !errors.Is(videoErr, ErrTokenExpired) || !strings.Contains(videoErr.Error(), "getting fresh URLs failed") {
+		t.Fatalf("Download: %v, want expiry after %d refreshes", videoErr, maxTokenRefreshes)
+	}
+}
+
+// A rendition refused from its first segment has a token scoped to another
+// rendition, which the fallback handles, even while the audio downloads
+func TestDownloadRefusedRenditionIsNotExpiry(t *testing.T) {
+	// The video is only refused once some audio has arrived
+	var mu sync.Mutex
+	audioServed := 0
+	audioStarted := make(chan struct{})
+	srv := httptest.NewServer(segmentHandler(func(r *http.Request) bool {
+		if strings.HasPrefix(r.URL.Path, "/v1080/") {
+			<-audioStarted
+			return true
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if audioServed++; audioServed == 3 {
+			close(audioStarted)
+		}
+		return false
+	}))
+	defer srv.Close()
+
+	video, audio := testStream("v1080", 5), testStream("a", 20)
+	dir := t.TempDir()
+	d := &Downloader{Concurrent: 2, PerStream: true}
+	videoErr, audioErr := d.Download(&video, &audio, srv.URL+"/", filepath.Join(dir, "video.mp4"), filepath.Join(dir, "audio.m4a"))
+	if videoErr == nil || errors.Is(videoErr, ErrTokenExpired) {
+		t.Errorf("video error = %v, want a plain segment failure", videoErr)
+	}
+	if audioErr != nil {
+		t.Errorf("audio error = %v", audioErr)
+	}
+}
+
+func TestSkipMuxRemovesOutputsOnFailure(t *testing.T) {
+	srv := httptest.NewServer(segmentHandler(func(r *http.Request) bool {
+		return r.URL.Path == "/v/seg-3.m4s"
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	opts := testOptions(t)
+	opts.SkipMux = true
+	opts.NoFallback = true
+	opts.OutputFile = filepath.Join(dir, "out.mp4")
+	src := &playlistSource{
+		playlist:      Playlist{Video: []Stream{testStream("v", 5)}, Audio: []Stream{testStream("a", 5)}},
+		baseURLPrefix: srv.URL + "/",
+	}
+	if _, err := downloadFromPlaylist(opts, &Downloader{Concurrent: 1}, src); err == nil {
+		t.Fatal("downloadFromPlaylist succeeded with a failing segment")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("failed -skip-mux download left %v", entries)
+	}
+
+	// Nothing fails this time, and both streams are kept
+	src.playlist.Video[0] = testStream("v", 3)
+	outputs, err := downloadFromPlaylist(opts, &Downloader{Concurrent: 1}, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outputs) != 2 || readFile(t, outputs[0]) != wantStreamFile("v", 3) || readFile(t, outputs[1]) != wantStreamFile("a", 5) {
+		t.Errorf("outputs %v don't hold the streams", outputs)
+	}
+}
+
+func TestHTTPClientHeaderTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer srv.Close()
+
+	fast := newHTTPClient(0, time.Second, 20*time.Millisecond, nil, "", nil)
+	if resp, err := fast.Get(srv.URL); err == nil {
+		resp.Body.Close()
+		t.Error("request outlived -header-timeout")
+	}
+	patient := newHTTPClient(0, time.Second, time.Second, nil, "", nil)
+	resp, err := patient.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("request within -header-timeout: %v", err)
+	}
+	resp.Body.Close()
+}
+
+// ladder is a playlist's video streams, highest resolution first
+var ladder = []Stream{
+	{ID: "1080", Height: 1080, Bitrate: 5000000},
+	{ID: "720", Height: 720, Bitrate: 3000000},
+	{ID: "540", Height: 540, Bitrate: 1500000},
+	{ID: "360", Height: 360, AvgBitrate: 800000},
+}
+
+// streamID is the ID of a selected stream, "" for none
+func streamID(s *Stream) string {
+	if s == nil {
+		return ""
+	}
+	return s.ID
+}
+
+func TestSelectByMaxBitrate(t *testing.T) {
+	tests := []struct {
+		name    string
+		streams []Stream
+		maxKbps int
+		want    string
+	}{
+		{"above the best", ladder, 10000, "1080"},
+		{"exactly at the cap", ladder, 3000, "720"},
+		{"just below a stream", ladder, 2999, "540"},
+		{"average bitrate", ladder, 800, "360"},
+		{"none qualifies", ladder, 100, "360"},
+		{"empty", nil, 3000, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := streamID(selectByMaxBitrate(tt.streams, tt.maxKbps)); got != tt.want {
+				t.Errorf("selectByMaxBitrate(%d) = %q, want %q", tt.maxKbps, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectByTargetBitrate(t *testing.T) {
+	tie := []Stream{{ID: "high", Bitrate: 3000000}, {ID: "low", Bitrate: 1000000}}
+	tests := []struct {
+		name       string
+		streams    []Stream
+		targetKbps int
+		want       string
+	}{
+		{"exact", ladder, 1500, "540"},
+		{"closer above", ladder, 2500, "720"},
+		{"closer below", ladder, 2000, "540"},
+		{"above all", ladder, 20000, "1080"},
+		{"below all", ladder, 1, "360"},
+		{"tie prefers the higher resolution", tie, 2000, "high"},
+		{"empty", nil, 2000, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := streamID(selectByTargetBitrate(tt.streams, tt.targetKbps)); got != tt.want {
+				t.Errorf("selectByTargetBitrate(%d) = %q, want %q", tt.targetKbps, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWarnIgnoredSelection(t *testing.T) {
+	tests := []struct {
+		name          string
+		quality       string
+		videoIndex    int
+		maxBitrate    int
+		targetBitrate int
+		want          []string
+	}{
+		{"default quality", "best", -1, 1000, 0, nil},
+		{"quality alone", "720", -1, 0, 0, nil},
+		{"quality and max bitrate", "720", -1, 1000, 0, []string{"-max-bitrate selects the video, -quality 720 is ignored"}},
+		{"quality and target bitrate", "720", -1, 0, 1000, []string{"-target-bitrate selects the video, -quality 720 is ignored"}},
+		{"both bitrates", "best", -1, 1000, 2000, []string{"-max-bitrate selects the video, -target-bitrate is ignored"}},
+		{"video index overrides all", "720", 2, 1000, 2000, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var warnings bytes.Buffer
+			setLogOutputs(io.Discard, &warnings)
+			defer setLogOutputs(io.Discard, io.Discard)
+
+			warnIgnoredSelection(Options{
+				VideoQuality:  tt.quality,
+				VideoIndex:    tt.videoIndex,
+				MaxBitrate:    tt.maxBitrate,
+				TargetBitrate: tt.targetBitrate,
+			})
+			got := warnings.String()
+			if len(tt.want) == 0 && got != "" {
+				t.Errorf("warned %q, want nothing", got)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("warned %q, want %q", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNearestHeight(t *testing.T) {
+	tests := []struct {
+		name   string
+		height int
+		want   string
+	}{
+		{"exact", 720, "720"},
+		{"rounds down", 800, "720"},
+		{"rounds up", 1000, "1080"},
+		{"tie picks the lower", 630, "540"},
+		{"above all", 2160, "1080"},
+		{"below all", 144, "360"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := streamID(nearestHeight(ladder, tt.height)); got != tt.want {
+				t.Errorf("nearestHeight(%d) = %q, want %q", tt.height, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectVideoStream(t *testing.T) {
+	tests := map[string]string{
+		"best":  "1080",
+		"worst": "360",
+		"720":   "720",
+		"720p":  "720",
+		"480p":  "540",
+		"630":   "540",
+		"junk":  "1080",
+	}
+	for quality, want := range tests {
+		if got := streamID(selectVideoStream(ladder, quality)); got != want {
+			t.Errorf("selectVideoStream(%q) = %q, want %q", quality, got, want)
+		}
+	}
+}
+
+func TestParseCodecPreference(t *testing.T) {
+	got, err := parseCodecPreference(" AV1, hevc ,h264")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{"av01"}, {"hvc1", "hev1"}, {"avc1", "avc3"}}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("parseCodecPreference = %v, want %v", got, want)
+	}
+	for _, list := range []string{"h266", "av1,,h264", ""} {
+		if _, err := parseCodecPreference(list); err == nil {
+			t.Errorf("parseCodecPreference(%q) succeeded, want an error", list)
+		}
+	}
+}
+
+func TestPreferCodec(t *testing.T) {
+	streams := []Stream{
+		{ID: "1080-avc", Width: 1920, Height: 1080, Codecs: "avc1.640028", Bitrate: 5000000},
+		{ID: "1080-av1", Width: 1920, Height: 1080, Codecs: "av01.0.08M.08", Bitrate: 3000000},
+		{ID: "1080-hevc", Width: 1920, Height: 1080, Codecs: "hvc1.1.6.L120", Bitrate: 4000000},
+		{ID: "720-vp9", Width: 1280, Height: 720, Codecs: "vp09.00.40.08", Bitrate: 2000000},
+	}
+	mustParse := func(list string) [][]string {
+		preference, err := parseCodecPreference(list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return preference
+	}
+	tests := []struct {
+		name       string
+		preference string
+		maxKbps    int
+		want       string
+	}{
+		{"first choice available", "av1,hevc", 0, "1080-av1"},
+		{"falls to the second", "vp9,hevc", 0, "1080-hevc"},
+		{"selected already preferred", "h264,av1", 0, "1080-avc"},
+		{"no preferred codec at the resolution", "vp9", 0, "1080-avc"},
+		{"preferred over the bitrate cap", "hevc,av1", 3500, "1080-av1"},
+		{"every preferred over the cap", "av1", 2000, "1080-avc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := preferCodec(streams, &streams[0], mustParse(tt.preference), tt.maxKbps)
+			if got.ID != tt.want {
+				t.Errorf("preferCodec = %s, want %s", got.ID, tt.want)
+			}
+		})
+	}
+}
+
+// argPairs returns the values that follow each flag in args
+func argPairs(args []string, flag string) []string {
+	var values []string
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] == flag {
+			values = append(values, args[i+1])
+		}
+	}
+	return values
+}
+
+func TestMuxArgsMetadata(t *testing.T) {
+	opts := MuxOptions{
+		Container: containers["mp4"],
+		Metadata:  Metadata{Title: "A talk: part 1", Artist: "Speaker", Comment: "https://vimeo.com/1"},
+	}
+	args := muxArgs("v.mp4", "a.mp4", "out.mp4", opts)
+	got := argPairs(args, "-metadata")
+	want := []string{"title=A talk: part 1", "artist=Speaker", "comment=https://vimeo.com/1"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("-metadata pairs = %q, want %q", got, want)
+	}
+
+	// Unset tags are left out rather than written empty
+	opts.Metadata = Metadata{Title: "Only a title"}
+	if got := argPairs(muxArgs("v.mp4", "a.mp4", "out.mp4", opts), "-metadata"); len(got) != 1 || got[0] != "title=Only a title" {
+		t.Errorf("-metadata pairs = %q, want only the title", got)
+	}
+}
+
+func TestMuxArgsFastStart(t *testing.T) {
+	tests := []struct {
+		container string
+		fastStart bool
+		output    string
+		want      string
+	}{
+		{"mp4", true, "out.mp4", "+faststart"},
+		{"mov", true, "out.mov", "+faststart"},
+		{"mkv", true, "out.mkv", ""},
+		{"webm", true, "out.webm", ""},
+		{"mp4", false, "out.mp4", ""},
+		// A pipe is written fragmented, it can't be rewritten for faststart
+		{"mp4", true, stdoutOutput, "frag_keyframe+empty_moov"},
+		{"mov", false, stdoutOutput, "frag_keyframe+empty_moov"},
+		{"mkv", true, stdoutOutput, ""},
+	}
+	for _, tt := range tests {
+		opts := MuxOptions{Container: containers[tt.container], FastStart: tt.fastStart}
+		got := strings.Join(argPairs(muxArgs("v.mp4", "a.mp4", tt.output, opts), "-movflags"), " ")
+		if got != tt.want {
+			t.Errorf("%s to %s with faststart %v: -movflags %q, want %q", tt.container, tt.output, tt.fastStart, got, tt.want)
+		}
+	}
+}
+
+func TestResolveMetadata(t *testing.T) {
+	playlist := &Playlist{ClipID: "clip"}
+	source := "https://example.com/playlist.json?exp=1&hmac=secret"
+
+	got := resolveMetadata("", "", "", nil, playlist, source)
+	if want := (Metadata{Title: "clip", Comment: "https://example.com/playlist.json"}); got != want {
+		t.Errorf("without a config: %+v, want %+v", got, want)
+	}
+
+	config := &PlayerConfig{}
+	config.Video.Title = "Config title"
+	config.Video.URL = "https://vimeo.com/1"
+	config.Video.Owner.Name = "Owner"
+	got = resolveMetadata("", "", "", config, playlist, source)
+	if want := (Metadata{Title: "Config title", Artist: "Owner", Comment: "https://vimeo.com/1"}); got != want {
+		t.Errorf("from the config: %+v, want %+v", got, want)
+	}
+
+	got = resolveMetadata("Flag title", "Flag artist", "Flag comment", config, playlist, source)
+	if want := (Metadata{Title: "Flag title", Artist: "Flag artist", Comment: "Flag comment"}); got != want {
+		t.Errorf("from the flags: %+v, want %+v", got, want)
+	}
+}
+
+func TestDownloadSingleTrackPlaylists(t *testing.T) {
+	srv := httptest.NewServer(segmentHandler(nil))
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		playlist Playlist
+		want     string
+	}{
+		{"no video", Playlist{Video: []Stream{}, Audio: []Stream{testStream("a", 3)}}, wantStreamFile("a", 3)},
+		{"no audio", Playlist{Video: []Stream{testStream("v", 4)}, Audio: []Stream{}}, wantStreamFile("v", 4)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// No ffmpeg: a single track is written as it is
+			t.Setenv("PATH", "")
+			opts := testOptions(t)
+			opts.OutputFile = filepath.Join(t.TempDir(), "out.mp4")
+			src := &playlistSource{playlist: tt.playlist, baseURLPrefix: srv.URL + "/"}
+			outputs, err := downloadFromPlaylist(opts, &Downloader{Concurrent: 2}, src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(outputs) != 1 || readFile(t, outputs[0]) != tt.want {
+				t.Errorf("outputs %v, want %s holding the track", outputs, opts.OutputFile)
+			}
+		})
+	}
+}
+
+func TestDownloadEmptyPlaylists(t *testing.T) {
+	tests := []struct {
+		name     string
+		playlist Playlist
+		opts     func(*Options)
+	}{
+		{"no streams", Playlist{}, nil},
+		{"-video-index without video", Playlist{Audio: []Stream{testStream("a", 1)}}, func(o *Options) { o.VideoIndex = 0 }},
+		{"-audio-index without audio", Playlist{Video: []Stream{testStream("v", 1)}}, func(o *Options) { o.AudioIndex = 0 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := testOptions(t)
+			opts.OutputFile = filepath.Join(t.TempDir(), "out.mp4")
+			if tt.opts != nil {
+				tt.opts(&opts)
+			}
+			src := &playlistSource{playlist: tt.playlist, baseURLPrefix: "http://unused/"}
+			if _, err := downloadFromPlaylist(opts, &Downloader{Concurrent: 1}, src); err == nil {
+				t.Error("downloadFromPlaylist succeeded")
+			}
+		})
+	}
+}
+
+func TestMuxStreamsFailure(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   string
+	}{
+		{"non-zero exit", `echo "Invalid data found when processing input" >&2; echo partial > "$last"; exit 1`, "Invalid data found"},
+		{"no output", `exit 0`, "output missing"},
+		{"empty output", `: > "$last"`, "is empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeFFmpeg(t, tt.script)
+			output := filepath.Join(t.TempDir(), "out.mp4")
+			err := muxStreams("v.mp4", "a.mp4", output, MuxOptions{Container: containers["mp4"]})
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("muxStreams: %v, want an error with %q", err, tt.want)
+			}
+			if tt.name == "non-zero exit" {
+				if _, err := os.Stat(output); err == nil {
+					t.Error("the partial output of a failed ffmpeg was kept")
+				}
+			}
+		})
+	}
+}
+
+func TestDownloadReportsMuxFailure(t *testing.T) {
+	fakeFFmpeg(t, `exit 1`)
+	srv := httptest.NewServer(segmentHandler(nil))
+	defer srv.Close()
+
+	opts := testOptions(t)
+	opts.OutputFile = filepath.Join(t.TempDir(), "out.mp4")
+	src := &playlistSource{
+		playlist:      Playlist{Video: []Stream{testStream("v", 2)}, Audio: []Stream{testStream("a", 2)}},
+		baseURLPrefix: srv.URL + "/",
+	}
+	outputs, err := downloadFromPlaylist(opts, &Downloader{Concurrent: 2}, src)
+	if err == nil || !strings.Contains(err.Error(), "muxing") {
+		t.Errorf("downloadFromPlaylist = %v, %v, want a muxing error", outputs, err)
+	}
+}
+
+func TestIsCopyUnsupported(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&ffmpegError{err: errors.New("exit status 1"), log: "[mp4 @ 0x1] Could not find tag for codec vp9 in stream #0"}, true},
+		{fmt.Errorf("muxing: %w", &ffmpegError{err: errors.New("exit status 1"), log: "opus in MP4 not currently supported in container"}), true},
+		{&ffmpegError{err: errors.New("exit status 1"), log: "Invalid data found when processing input"}, false},
+		{errors.New("Could not find tag for codec"), false},
+	}
+	for _, tt := range tests {
+		if got := isCopyUnsupported(tt.err); got != tt.want {
+			t.Errorf("isCopyUnsupported(%q) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestDownloadReencodesWhenCopyFails(t *testing.T) {
+	// The fake ffmpeg logs its runs and fails to copy unless the flag in
+	// $REENCODE_WITH is passed
+	script := `echo "$@" >> "$FFMPEG_RUNS"
+case " $* " in
+*" $REENCODE_WITH "*) echo muxed > "$last" ;;
+*) echo "[mp4 @ 0x1] Could not find tag for codec vp9 in stream #0" >&2; exit 1 ;;
+esac`
+	srv := httptest.NewServer(segmentHandler(nil))
+	defer srv.Close()
+
+	tests := []struct {
+		name       string
+		with       string
+		noReencode bool
+		runs       int
+		wantErr    bool
+	}{
+		{"copy works", "-c", false, 1, false},
+		{"audio reencoded", "-c:a", false, 2, false},
+		{"everything reencoded", "-c:v:0", false, 3, false},
+		{"-no-reencode", "-c:a", true, 1, true},
+		{"reencoding fails too", "-never", false, 3, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeFFmpeg(t, script)
+			runsFile := filepath.Join(t.TempDir(), "runs")
+			t.Setenv("FFMPEG_RUNS", runsFile)
+			t.Setenv("REENCODE_WITH", tt.with)
+
+			opts := testOptions(t)
+			opts.NoReencode = tt.noReencode
+			opts.OutputFile = filepath.Join(t.TempDir(), "out.mp4")
+			src := &playlistSource{
+				playlist:      Playlist{Video: []Stream{testStream("v", 2)}, Audio: []Stream{testStream("a", 2)}},
+				baseURLPrefix: srv.URL + "/",
+			}
+			_, err := downloadFromPlaylist(opts, &Downloader{Concurrent: 2}, src)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("downloadFromPlaylist: %v, want an error %v", err, tt.wantErr)
+			}
+			runs := strings.Split(strings.TrimSpace(readFile(t, runsFile)), "\n")
+			if len(runs) != tt.runs {
+				t.Fatalf("ffmpeg ran %d times, want %d: %q", len(runs), tt.runs, runs)
+			}
+			// The audio is reencoded on its own before the video is touched
+			if tt.runs >= 2 && (!strings.Contains(runs[1], "-c:a aac") || strings.Contains(runs[1], "-c:v:0")) {
+				t.Errorf("second run %q, want only the audio reencoded", runs[1])
+			}
+			if tt.runs == 3 && !strings.Contains(runs[2], "-c:v:0 libx264 -c:a aac") {
+				t.Errorf("third run %q, want the video and audio reencoded", runs[2])
+			}
+		})
+	}
+}
+
+// rangeStream returns a stream of n byte ranges of 10 bytes each in one
+// media.mp4, and that file
+func rangeStream(n int) (Stream, []byte) {
+	media := make([]byte, 10*n)
+	for i := range media {
+		media[i] = byte('a' + i%26)
+	}
+	stream := Stream{ID: "v", BaseURL: "v/"}
+	for i := 0; i < n; i++ {
+		stream.Segments = append(stream.Segments, Segment{
+			URL:   "media.mp4",
+			Range: &ByteRange{Start: int64(10 * i), End: int64(10*i + 9)},
+			Size:  10,
+		})
+	}
+	return stream, media
+}
+
+func TestDownloadByteRanges(t *testing.T) {
+	stream, media := rangeStream(8)
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{"range requests", func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Range") == "" {
+				http.Error(w, "range expected", http.StatusBadRequest)
+				return
+			}
+			http.ServeContent(w, r, "media.mp4", time.Time{}, strings.NewReader(string(media)))
+		}},
+		{"server ignoring Range", func(w http.ResponseWriter, r *http.Request) {
+			w.Write(media)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(tt.handler)
+			defer srv.Close()
+
+			output := filepath.Join(t.TempDir(), "video.mp4")
+			stream := stream
+			videoErr, _ := (&Downloader{Concurrent: 3}).Download(&stream, nil, srv.URL+"/", output, "")
+			if videoErr != nil {
+				t.Fatal(videoErr)
+			}
+			if got := readFile(t, output); got != string(media) {
+				t.Errorf("reassembled %q, want %q", got, media)
+			}
+		})
+	}
+}
+
+func TestDownloadToMemoryShortRange(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("too short"))
+	}))
+	defer srv.Close()
+
+	d := &Downloader{Concurrent: 1}
+	if _, err := d.downloadToMemory(srv.URL, &ByteRange{Start: 5, End: 100}); err == nil {
+		t.Error("a range past the end of the response was accepted")
+	}
+}
+
+func TestByteRangeJSON(t *testing.T) {
+	var seg Segment
+	if err := json.Unmarshal([]byte(`{"url": "media.mp4", "range": "100-199"}`), &seg); err != nil {
+		t.Fatal(err)
+	}
+	if seg.Range == nil || *seg.Range != (ByteRange{Start: 100, End: 199}) || seg.Range.Len() != 100 {
+		t.Errorf("range = %+v", seg.Range)
+	}
+	for _, bad := range []string{`"199-100"`, `"-5"`, `"abc"`, `100`} {
+		var r ByteRange
+		if err := json.Unmarshal([]byte(bad), &r); err == nil {
+			t.Errorf("range %s accepted", bad)
+		}
+	}
+}
+
+func TestGetBaseURLPrefix(t *testing.T) {
+	tests := []struct {
+		name         string
+		playlistURL  string
+		relativeBase string
+		want         string
+	}{
+		{"climbing", "https://cdn.example.com/exp=1~acl=x/a/b/c/sep/video/playlist.json?base64_init=1", "../../../../../range/prot/", "https://cdn.example.com/exp=1~acl=x/range/prot/"},
+		{"same directory", "https://cdn.example.com/a/b/playlist.json", "", "https://cdn.example.com/a/b/"},
+		{"dot", "https://cdn.example.com/a/b/playlist.json", "./", "https://cdn.example.com/a/b/"},
+		{"down", "https://cdn.example.com/a/playlist.json", "video/1080", "https://cdn.example.com/a/video/1080/"},
+		{"past the root", "https://cdn.example.com/a/playlist.json", "../../../x/", "https://cdn.example.com/x/"},
+		{"backslash-free on every OS", "https://host/a/b/c/playlist.json", "../d/", "https://host/a/b/d/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := getBaseURLPrefix(tt.playlistURL, tt.relativeBase)
+			if got != tt.want {
+				t.Errorf("getBaseURLPrefix = %s, want %s", got, tt.want)
+			}
+			if strings.Contains(got, `\`) {
+				t.Errorf("getBaseURLPrefix = %s, which has a backslash", got)
+			}
+		})
+	}
+}
+
+func TestDownloadAfterPlaylistRedirect(t *testing.T) {
+	t.Setenv("PATH", "")
+	playlist, err := json.Marshal(Playlist{ClipID: "clip", BaseURL: "../", Audio: []Stream{testStream("a", 3)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The segments only exist relative to where the redirect leads
+	mux := http.NewServeMux()
+	mux.Handle("/short/playlist.json", http.RedirectHandler("/cdn/sep/video/playlist.json", http.StatusFound))
+	mux.HandleFunc("/cdn/sep/video/playlist.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(playlist)
+	})
+	mux.Handle("/cdn/sep/", http.StripPrefix("/cdn/sep", segmentHandler(nil)))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	d := &Downloader{Concurrent: 2}
+	data, finalURL, err := d.fetchWithRetry(srv.URL + "/short/playlist.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := srv.URL + "/cdn/sep/video/playlist.json"; finalURL != want {
+		t.Errorf("final URL %s, want %s", finalURL, want)
+	}
+	if _, prefix, err := d.loadPlaylist(data, finalURL); err != nil || prefix != srv.URL+"/cdn/sep/" {
+		t.Errorf("prefix %q, %v, want %s/cdn/sep/", prefix, err, srv.URL)
+	}
+
+	opts := testOptions(t)
+	opts.Concurrent = 2
+	opts.SubsFormat = "vtt"
+	opts.PlaylistURL = srv.URL + "/short/playlist.json"
+	opts.OutputFile = filepath.Join(t.TempDir(), "out.mp4")
+	if err := downloadVideo(opts); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, opts.OutputFile); got != wantStreamFile("a", 3) {
+		t.Errorf("wrote %q, want the audio track", got)
+	}
+}
+
+func TestSegmentQuery(t *testing.T) {
+	selfContained := &Playlist{Video: []Stream{{Segments: []Segment{{URL: "s1.m4s?token=a"}, {URL: "s2.m4s?token=b"}}}}}
+	baseQuery := &Playlist{Audio: []Stream{{BaseURL: "audio/?token=a&", Segments: []Segment{{URL: "s1.m4s"}}}}}
+	bare := &Playlist{
+		Video: []Stream{{Segments: []Segment{{URL: "s1.m4s?token=a"}}}},
+		Audio: []Stream{{Segments: []Segment{{URL: "s1.m4s"}}}},
+	}
+	tests := []struct {
+		name        string
+		playlistURL string
+		playlist    *Playlist
+		want        string
+	}{
+		{"segments carry their own query", "https://cdn/p.json?exp=1&hmac=x", selfContained, ""},
+		{"query in the stream base URL", "https://cdn/p.json?exp=1&hmac=x", baseQuery, ""},
+		{"token must be propagated", "https://cdn/p.json?exp=1&hmac=x", bare, "exp=1&hmac=x"},
+		{"playlist URL without a query", "https://cdn/p.json", bare, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := segmentQuery(tt.playlistURL, tt.playlist); got != tt.want {
+				t.Errorf("segmentQuery = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDownloadPropagatesQuery(t *testing.T) {
+	var mu sync.Mutex
+	var queries []string
+	srv := httptest.NewServer(segmentHandler(func(r *http.Request) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		queries = append(queries, r.URL.RawQuery)
+		return r.URL.Query().Get("hmac") != "x"
+	}))
+	defer srv.Close()
+
+	video := testStream("v", 3)
+	// A segment with its own query keeps it
+	video.Segments[2].URL += "?hmac=x&own=1"
+	d := &Downloader{Concurrent: 1, Query: "exp=1&hmac=x"}
+	if videoErr, _ := d.Download(&video, nil, srv.URL+"/", filepath.Join(t.TempDir(), "v.mp4"), ""); videoErr != nil {
+		t.Fatal(videoErr)
+	}
+	sort.Strings(queries)
+	want := []string{"exp=1&hmac=x", "exp=1&hmac=x", "hmac=x&own=1"}
+	if strings.Join(queries, " ") != strings.Join(want, " ") {
+		t.Errorf("segment queries %q, want %q", queries, want)
+	}
+}
+
+func TestDownloadAllowMissing(t *testing.T) {
+	// Not found rather than refused, so the failures don't look like an
+	// expired token
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "seg-1.m4s") || strings.HasSuffix(r.URL.Path, "seg-4.m4s") {
+			http.NotFound(w, r)
+			return
+		}
+		segmentHandler(nil).ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		allow   int
+		wantErr string
+	}{
+		{0, "segment"},
+		{1, "more than -allow-missing 1 segments failed"},
+		{2, ""},
+		{3, ""},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("allow %d", tt.allow), func(t *testing.T) {
+			stream := testStream("v", 6)
+			output := filepath.Join(t.TempDir(), "video.mp4")
+			d := &Downloader{Concurrent: 2, AllowMissing: tt.allow}
+			videoErr, _ := d.Download(&stream, nil, srv.URL+"/", output, "")
+
+			if tt.wantErr != "" {
+				if videoErr == nil || !strings.Contains(videoErr.Error(), tt.wantErr) {
+					t.Fatalf("error %v, want one mentioning %q", videoErr, tt.wantErr)
+				}
+				if tt.allow == 0 && strings.Contains(videoErr.Error(), "-allow-missing") {
+					t.Errorf("error %v mentions -allow-missing, which wasn't given", videoErr)
+				}
+				if _, err := os.Stat(output); err == nil {
+					t.Error("a failed download left its output")
+				}
+				return
+			}
+			if videoErr != nil {
+				t.Fatal(videoErr)
+			}
+			if got := d.missing[VideoStream]; len(got) != 2 || got[0] != 1 || got[1] != 4 {
+				t.Errorf("missing segments %v, want [1 4]", got)
+			}
+			want := segmentBody("v", 0) + segmentBody("v", 2) + segmentBody("v", 3) + segmentBody("v", 5)
+			if got := readFile(t, output); got != want {
+				t.Errorf("wrote %q, want the other segments %q", got, want)
+			}
+		})
+	}
+}
+
+// countingTransport sends the requests for host video.test to target and
+// counts them. The shared httpClient can't reach video.test, so a request
+// that arrives went through the client it belongs to.
+type countingTransport struct {
+	target   string
+	requests atomic.Int64
+}
+
+func (c *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	c.requests.Add(1)
+	r = r.Clone(r.Context())
+	r.URL.Scheme = "http"
+	r.URL.Host = c.target
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func countingClient(srv *httptest.Server) (*http.Client, *countingTransport) {
+	transport := &countingTransport{target: strings.TrimPrefix(srv.URL, "http://")}
+	return &http.Client{Transport: transport}, transport
+}
+
+func TestDownloaderClient(t *testing.T) {
+	srv := httptest.NewServer(segmentHandler(nil))
+	defer srv.Close()
+	client, transport := countingClient(srv)
+
+	d := &Downloader{Concurrent: 2, Client: client}
+	video, audio := testStream("v", 4), testStream("a", 3)
+	dir := t.TempDir()
+	videoErr, audioErr := d.Download(&video, &audio, "http://video.test/", filepath.Join(dir, "v.mp4"), filepath.Join(dir, "a.mp4"))
+	if videoErr != nil || audioErr != nil {
+		t.Fatal(videoErr, audioErr)
+	}
+	if got := transport.requests.Load(); got != 7 {
+		t.Errorf("%d requests through the client, want one per segment, 7", got)
+	}
+
+	transport.requests.Store(0)
+	if err := d.CheckURLs(&video, nil, "http://video.test/"); err != nil {
+		t.Fatal(err)
+	}
+	if got := transport.requests.Load(); got != 4 {
+		t.Errorf("-check-urls sent %d requests through the client, want 4", got)
+	}
+}
+
+func TestDownloadVideoUsesOptionsClient(t *testing.T) {
+	t.Setenv("PATH", "")
+	playlist, err := json.Marshal(Playlist{ClipID: "clip", Audio: []Stream{testStream("a", 3)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/playlist.json" {
+			w.Write(playlist)
+			return
+		}
+		segmentHandler(nil).ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	client, transport := countingClient(srv)
+
+	opts := testOptions(t)
+	opts.Concurrent = 2
+	opts.SubsFormat = "vtt"
+	opts.client = client
+	opts.PlaylistURL = "http://video.test/playlist.json"
+	opts.OutputFile = filepath.Join(t.TempDir(), "out.mp4")
+	if err := downloadVideo(opts); err != nil {
+		t.Fatal(err)
+	}
+	if got := transport.requests.Load(); got != 4 {
+		t.Errorf("%d requests through the options' client, want the playlist and 3 segments", got)
+	}
+	if got := readFile(t, opts.OutputFile); got != wantStreamFile("a", 3) {
+		t.Errorf("wrote %q, want the audio track", got)
+	}
+}
+
+func TestDownloadMaxSize(t *testing.T) {
+	var requests atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		segmentHandler(nil).ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	// Each segment is 5 bytes, the limit trips on the third
+	opts := testOptions(t)
+	opts.OutputFile = filepath.Join(t.TempDir(), "out.mp4")
+	src := &playlistSource{
+		playlist:      Playlist{Video: []Stream{testStream("v", 10), testStream("v2", 10)}, Audio: []Stream{testStream("a", 10)}},
+		baseURLPrefix: srv.URL + "/",
+	}
+	_, err := downloadFromPlaylist(opts, &Downloader{Concurrent: 1, MaxSize: 12}, src)
+	if !errors.Is(err, ErrMaxSizeExceeded) {
+		t.Fatalf("error %v, want ErrMaxSizeExceeded", err)
+	}
+	// Going on would only download more, so the other segments and the
+	// fallback to another rendition are skipped
+	if got := requests.Load(); got > 4 {
+		t.Errorf("%d segment requests, want the download stopped after the third", got)
+	}
+	if _, err := os.Stat(opts.OutputFile); err == nil {
+		t.Error("an aborted download left its output")
+	}
+	if entries, _ := os.ReadDir(opts.TempDir); len(entries) != 0 {
+		t.Errorf("an aborted download left %v in the temp directory", entries)
+	}
+}
+
+func TestDownloadFetchesDuplicatesOnce(t *testing.T) {
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	media := "0123456789abcdefghij"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path+" "+r.Header.Get("Range")]++
+		mu.Unlock()
+		if r.URL.Path == "/v/media.mp4" {
+			http.ServeContent(w, r, "media.mp4", time.Time{}, strings.NewReader(media))
+			return
+		}
+		segmentHandler(nil).ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	// A discontinuity repeats seg-0, and two ranges of media.mp4 repeat too
+	video := Stream{ID: "v", BaseURL: "v/", Segments: []Segment{
+		{URL: "seg-0.m4s"},
+		{URL: "seg-1.m4s"},
+		{URL: "seg-0.m4s"},
+		{URL: "media.mp4", Range: &ByteRange{Start: 0, End: 9}},
+		{URL: "media.mp4", Range: &ByteRange{Start: 10, End: 19}},
+		{URL: "media.mp4", Range: &ByteRange{Start: 0, End: 9}},
+	}}
+	output := filepath.Join(t.TempDir(), "v.mp4")
+	if videoErr, _ := (&Downloader{Concurrent: 4}).Download(&video, nil, srv.URL+"/", output, ""); videoErr != nil {
+		t.Fatal(videoErr)
+	}
+
+	want := map[string]int{
+		"/v/seg-0.m4s ":            1,
+		"/v/seg-1.m4s ":            1,
+		"/v/media.mp4 bytes=0-9":   1,
+		"/v/media.mp4 bytes=10-19": 1,
+	}
+	if len(requests) != len(want) {
+		t.Errorf("requests %v, want %v", requests, want)
+	}
+	for key, n := range want {
+		if requests[key] != n {
+			t.Errorf("%d requests for %q, want %d", requests[key], key, n)
+		}
+	}
+	seg0, seg1 := segmentBody("v", 0), segmentBody("v", 1)
+	if got, want := readFile(t, output), seg0+seg1+seg0+media[:10]+media[10:]+media[:10]; got != want {
+		t.Errorf("output %q, want %q", got, want)
+	}
+}
+
+// inFlightHandler is segmentHandler recording the most requests it served
+// at once, holding each for a moment so they overlap
+type inFlightHandler struct {
+	mu       sync.Mutex
+	current  int
+	max      int
+	requests int
+}
+
+func (h *inFlightHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	h.current++
+	h.requests++
+	h.max = max(h.max, h.current)
+	h.mu.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	segmentHandler(nil).ServeHTTP(w, r)
+	h.mu.Lock()
+	h.current--
+	h.mu.Unlock()
+}
+
+func TestClampConcurrency(t *testing.T) {
+	tests := []struct {
+		name       string
+		concurrent int
+		max        int
+		want       int
+		wantErr    string
+		wantWarn   bool
+	}{
+		{"within the max", 8, 64, 8, "", false},
+		{"at the max", 64, 64, 64, "", false},
+		{"above the max", 500, 64, 64, "", true},
+		{"zero", 0, 64, 0, "-c must be at least 1, got 0", false},
+		{"negative", -3, 64, 0, "-c must be at least 1, got -3", false},
+		{"zero max", 8, 0, 0, "-max-concurrency must be at least 1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var warnings bytes.Buffer
+			setLogOutputs(io.Discard, &warnings)
+			defer setLogOutputs(io.Discard, io.Discard)
+
+			got, err := clampConcurrency(tt.concurrent, tt.max)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("clampConcurrency = %d, %v, want an error with %q", got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("clampConcurrency = %d, %v, want %d", got, err, tt.want)
+			}
+			if warned := strings.Contains(warnings.String(), "-max-concurrency"); warned != tt.wantWarn {
+				t.Errorf("warned %v, want %v: %q", warned, tt.wantWarn, warnings.String())
+			}
+		})
+	}
+}
+
+func TestDownloadNoConcurrency(t *testing.T) {
+	// No request is made, a zero Concurrent would wait forever for a slot
+	video, audio := testStream("v", 2), testStream("a", 2)
+	for _, concurrent := range []int{0, -1} {
+		d := &Downloader{Concurrent: concurrent}
+		videoErr, audioErr := d.Download(&video, &audio, "http://video.test/", "v.mp4", "a.mp4")
+		if videoErr != errNoConcurrency || audioErr != errNoConcurrency {
+			t.Errorf("Concurrent %d: %v, %v, want errNoConcurrency for both", concurrent, videoErr, audioErr)
+		}
+		if videoErr, audioErr := d.Download(nil, &audio, "http://video.test/", "", "a.mp4"); videoErr != nil || audioErr != errNoConcurrency {
+			t.Errorf("Concurrent %d, audio only: %v, %v, want errNoConcurrency for the audio", concurrent, videoErr, audioErr)
+		}
+	}
+}
+
+func TestDownloadConcurrencyLimit(t *testing.T) {
+	tests := []struct {
+		name      string
+		perStream bool
+		want      int
+	}{
+		{"shared by both streams", false, 3},
+		{"per stream", true, 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := &inFlightHandler{}
+			srv := httptest.NewServer(handler)
+			defer srv.Close()
+
+			video, audio := testStream("v", 20), testStream("a", 20)
+			dir := t.TempDir()
+			d := &Downloader{Concurrent: 3, PerStream: tt.perStream}
+			videoErr, audioErr := d.Download(&video, &audio, srv.URL+"/", filepath.Join(dir, "v.mp4"), filepath.Join(dir, "a.mp4"))
+			if videoErr != nil || audioErr != nil {
+				t.Fatal(videoErr, audioErr)
+			}
+			if handler.max > tt.want {
+				t.Errorf("%d requests in flight, want at most %d", handler.max, tt.want)
+			}
+			if handler.requests != 40 {
+				t.Errorf("%d requests, want 40", handler.requests)
+			}
+		})
+	}
+}
+
+func TestResolveContainer(t *testing.T) {
+	h264 := &Stream{Codecs: "avc1.640028", MimeType: "video/mp4"}
+	hevc := &Stream{Codecs: "hvc1.1.6.L120.90", MimeType: "video/mp4"}
+	av1 := &Stream{Codecs: "av01.0.08M.08", MimeType: "video/mp4"}
+	vp9 := &Stream{Codecs: "vp09.00.40.08", MimeType: "video/mp4"}
+	aac := &Stream{Codecs: "mp4a.40.2", MimeType: "audio/mp4"}
+	opus := &Stream{Codecs: "opus", MimeType: "audio/mp4"}
+	tests := []struct {
+		name    string
+		format  string
+		output  string
+		streams []*Stream
+		want    string
+	}{
+		{"h264 and aac", "", "", []*Stream{h264, aac}, "mp4"},
+		{"hevc and aac", "", "", []*Stream{hevc, aac}, "mp4"},
+		{"av1", "", "", []*Stream{av1, aac}, "mkv"},
+		{"vp9", "", "", []*Stream{vp9, aac}, "mkv"},
+		{"opus audio", "", "", []*Stream{h264, opus}, "mkv"},
+		{"audio only", "", "", []*Stream{nil, aac}, "mp4"},
+		{"no codec information", "", "", []*Stream{{}, {}}, "mp4"},
+		{"from the extension", "", "out.WEBM", []*Stream{vp9, opus}, "webm"},
+		{"unknown extension", "", "out.avi", []*Stream{vp9, aac}, "mkv"},
+		{"-format wins", "MOV", "out.mkv", []*Stream{vp9, opus}, "mov"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := resolveContainer(tt.format, tt.output, tt.streams...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Name != tt.want {
+				t.Errorf("resolveContainer = %s, want %s", c.Name, tt.want)
+			}
+		})
+	}
+	if _, err := resolveContainer("avi", "", h264); err == nil {
+		t.Error("-format avi accepted")
+	}
+}
+
+func TestContainerSupports(t *testing.T) {
+	vp9 := &Stream{Codecs: "vp09.00.40.08", MimeType: "video/mp4"}
+	opus := &Stream{Codecs: "opus", MimeType: "audio/mp4"}
+	if containers["mp4"].supports(vp9) {
+		t.Error("MP4 claims to take VP9")
+	}
+	if !containers["mp4"].supports(opus) || !containers["webm"].supports(vp9) || !containers["mkv"].supports(vp9) {
+		t.Error("a supported codec was refused")
+	}
+}
+
+func TestDownloadRemovesTempDirOnError(t *testing.T) {
+	srv := httptest.NewServer(segmentHandler(func(r *http.Request) bool {
+		return strings.HasSuffix(r.URL.Path, "seg-2.m4s")
+	}))
+	defer srv.Close()
+
+	for _, keep := range []bool{false, true} {
+		opts := testOptions(t)
+		opts.KeepTemp = keep
+		opts.NoFallback = true
+		opts.OutputFile = filepath.Join(t.TempDir(), "out.mp4")
+		src := &playlistSource{
+			playlist:      Playlist{Video: []Stream{testStream("v", 4)}, Audio: []Stream{testStream("a", 4)}},
+			baseURLPrefix: srv.URL + "/",
+		}
+		if _, err := downloadFromPlaylist(opts, &Downloader{Concurrent: 2}, src); err == nil {
+			t.Fatal("downloadFromPlaylist succeeded with a failing segment")
+		}
+		entries, _ := os.ReadDir(opts.TempDir)
+		if keep && len(entries) != 1 {
+			t.Errorf("-keep-temp left %v, want the temp directory", entries)
+		}
+		if !keep && len(entries) != 0 {
+			t.Errorf("failed download left %v in the temp directory", entries)
+		}
+	}
+}
+
+func TestReadPlaylistFile(t *testing.T) {
+	const playlist = `{"clip_id": "stdin"}`
+	data, err := readPlaylistFile("-", strings.NewReader(playlist))
+	if err != nil || string(data) != playlist {
+		t.Errorf("from stdin: %q, %v", data, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "playlist.json")
+	if err := os.WriteFile(path, []byte(playlist), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// stdin is only read for "-"
+	data, err = readPlaylistFile(path, iotest.ErrReader(errors.New("stdin read")))
+	if err != nil || string(data) != playlist {
+		t.Errorf("from a file: %q, %v", data, err)
+	}
+
+	if _, err := readPlaylistFile("-", iotest.ErrReader(errors.New("broken pipe"))); err == nil {
+		t.Error("a failing stdin was read without an error")
+	}
+	if _, err := readPlaylistFile(filepath.Join(t.TempDir(), "missing.json"), nil); err == nil {
+		t.Error("a missing file was read without an error")
+	}
+}
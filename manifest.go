@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Manifest records the checksums of a download for -manifest and -verify
+type Manifest struct {
+	Files []ManifestFile    `json:"files"`
+	Video []ManifestSegment `json:"video,omitempty"`
+	Audio []ManifestSegment `json:"audio,omitempty"`
+}
+
+// ManifestFile is an output file of the download
+type ManifestFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// ManifestSegment is one downloaded segment. The URL is recorded without
+// its query string, which holds short-lived tokens.
+type ManifestSegment struct {
+	Index  int    `json:"index"`
+	URL    string `json:"url"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// manifestRecorder collects segment checksums from the download goroutines
+type manifestRecorder struct {
+	mu       sync.Mutex
+	segments [2][]ManifestSegment
+}
+
+// record is a Downloader SegmentFunc
+func (m *manifestRecorder) record(stream StreamKind, index int, urlStr string, data []byte) {
+	seg := ManifestSegment{
+		Index:  index,
+		URL:    stripQuery(urlStr),
+		Size:   int64(len(data)),
+		SHA256: sha256Hex(data),
+	}
+	m.mu.Lock()
+	m.segments[stream] = append(m.segments[stream], seg)
+	m.mu.Unlock()
+}
+
+// reset drops what was recorded for stream, before it is downloaded again
+func (m *manifestRecorder) reset(stream StreamKind) {
+	m.mu.Lock()
+	m.segments[stream] = nil
+	m.mu.Unlock()
+}
+
+// restore sets the segments of stream to those recorded by an earlier
+// download of it
+func (m *manifestRecorder) restore(stream StreamKind, segments []ManifestSegment) {
+	m.mu.Lock()
+	m.segments[stream] = segments
+	m.mu.Unlock()
+}
+
+// manifest returns the recorded segments in order along with files
+func (m *manifestRecorder) manifest(files []ManifestFile) *Manifest {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, segs := range m.segments {
+		sort.Slice(segs, func(i, j int) bool { return segs[i].Index < segs[j].Index })
+	}
+	return &Manifest{Files: files, Video: m.segments[VideoStream], Audio: m.segments[AudioStream]}
+}
+
+// writeManifest writes manifest to path as indented JSON
+func writeManifest(path string, manifest *Manifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// checksumFile returns the size and SHA-256 of the file at path
+func checksumFile(path string) (ManifestFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return ManifestFile{}, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return ManifestFile{}, err
+	}
+	return ManifestFile{Path: path, Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// verifyManifest re-checks the files listed in the manifest at path,
+// reporting every mismatch before failing
+func verifyManifest(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading manifest: %w", err)
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("parsing manifest: %w", err)
+	}
+	if len(manifest.Files) == 0 {
+		return fmt.Errorf("manifest %s lists no files", path)
+	}
+
+	bad := 0
+	for _, want := range manifest.Files {
+		got, err := checksumFile(want.Path)
+		switch {
+		case err != nil:
+			errorf("%s: %v", want.Path, err)
+			bad++
+		case got.Size != want.Size:
+			errorf("%s: size is %d bytes, expected %d", want.Path, got.Size, want.Size)
+			bad++
+		case got.SHA256 != want.SHA256:
+			errorf("%s: SHA-256 mismatch", want.Path)
+			bad++
+		default:
+			resultf("OK %s", want.Path)
+		}
+	}
+	if bad > 0 {
+		return fmt.Errorf("%d of %d files failed verification", bad, len(manifest.Files))
+	}
+	return nil
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// stripQuery returns urlStr without its query string
+func stripQuery(urlStr string) string {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return urlStr
+	}
+	u.RawQuery = ""
+	return u.String()
+}
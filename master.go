@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// MasterPlaylist is a master.json that indexes one playlist.json per
+// rendition instead of listing the streams and their segments itself
+type MasterPlaylist struct {
+	ClipID  string      `json:"clip_id"`
+	BaseURL string      `json:"base_url"`
+	Video   []Rendition `json:"video"`
+	Audio   []Rendition `json:"audio"`
+}
+
+// Rendition is one entry of a master.json
+type Rendition struct {
+	ID       string `json:"id"`
+	BaseURL  string `json:"base_url"` // Relative to the master's base URL
+	Playlist string `json:"playlist"` // Rendition playlist.json, relative to BaseURL
+}
+
+// parseMasterPlaylist parses data as a master.json. ok is false for anything
+// else, including a flat playlist.json, whose streams carry segments
+// rather than a playlist reference.
+func parseMasterPlaylist(data []byte) (master *MasterPlaylist, ok bool) {
+	var m MasterPlaylist
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, false
+	}
+	if len(m.Video)+len(m.Audio) == 0 {
+		return nil, false
+	}
+	for _, renditions := range [][]Rendition{m.Video, m.Audio} {
+		for _, r := range renditions {
+			if r.Playlist == "" {
+				return nil, false
+			}
+		}
+	}
+	return &m, true
+}
+
+// renditionURL resolves the playlist URL of r relative to the master URL.
+// Both base URLs name directories, with or without a trailing slash.
+func (m *MasterPlaylist) renditionURL(masterURL string, r Rendition) string {
+	return getBaseURLPrefix(masterURL, m.BaseURL+"/"+r.BaseURL) + r.Playlist
+}
+
+// resolveMasterPlaylist fetches every rendition playlist of master and
+// merges their streams into one playlist. Each stream's BaseURL is made
+// absolute since the renditions don't share a base URL, so the returned
+// playlist needs no base URL prefix.
+func (d *Downloader) resolveMasterPlaylist(master *MasterPlaylist, masterURL string) (Playlist, error) {
+	playlist := Playlist{ClipID: master.ClipID}
+	for _, kind := range []StreamKind{VideoStream, AudioStream} {
+		renditions := master.Video
+		if kind == AudioStream {
+			renditions = master.Audio
+		}
+
+		for _, r := range renditions {
+			renditionURL := master.renditionURL(masterURL, r)
+			data, resolvedURL, err := d.fetchWithRetry(renditionURL)
+			if err != nil {
+				return Playlist{}, fmt.Errorf("fetching %s rendition %s: %w", kind, r.ID, err)
+			}
+			var p Playlist
+			if err := parsePlaylist(data, &p); err != nil {
+				return Playlist{}, fmt.Errorf("%s rendition %s: %w", kind, r.ID, err)
+			}
+
+			prefix := getBaseURLPrefix(resolvedURL, p.BaseURL)
+			streams := p.Video
+			if kind == AudioStream {
+				streams = p.Audio
+			}
+			for _, s := range streams {
+				s.BaseURL = prefix + s.BaseURL
+				if kind == VideoStream {
+					playlist.Video = append(playlist.Video, s)
+				} else {
+					playlist.Audio = append(playlist.Audio, s)
+				}
+			}
+		}
+	}
+	return playlist, nil
+}
+
+// loadPlaylist parses data fetched from playlistURL, which is either a flat
+// playlist.json or a master.json, and returns the playlist with the prefix
+// its stream base URLs are relative to
+func (d *Downloader) loadPlaylist(data []byte, playlistURL string) (Playlist, string, error) {
+	if master, ok := parseMasterPlaylist(data); ok {
+		infof("Master playlist with %d video and %d audio renditions, fetching their playlists...", len(master.Video), len(master.Audio))
+		playlist, err := d.resolveMasterPlaylist(master, playlistURL)
+		return playlist, "", err
+	}
+
+	var playlist Playlist
+	if err := parsePlaylist(data, &playlist); err != nil {
+		return Playlist{}, "", err
+	}
+	return playlist, getBaseURLPrefix(playlistURL, playlist.BaseURL), nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// masterFixture is a master.json in the layout Vimeo serves, its
+// renditions' playlists one directory up from it
+const masterFixture = `{
+  "clip_id": "clip",
+  "base_url": "../parts",
+  "video": [
+    {"id": "v1080", "base_url": "video/1080/", "playlist": "playlist.json"},
+    {"id": "v720", "base_url": "video/720", "playlist": "playlist.json"}
+  ],
+  "audio": [
+    {"id": "a128", "base_url": "audio/128/", "playlist": "playlist.json"}
+  ]
+}`
+
+func TestParseMasterPlaylist(t *testing.T) {
+	master, ok := parseMasterPlaylist([]byte(masterFixture))
+	if !ok {
+		t.Fatal("master.json not recognized")
+	}
+	if len(master.Video) != 2 || len(master.Audio) != 1 {
+		t.Errorf("%d video and %d audio renditions, want 2 and 1", len(master.Video), len(master.Audio))
+	}
+
+	// A flat playlist.json has streams, not playlist references
+	flat := `{"clip_id": "clip", "base_url": "../", "video": [{"id": "v", "segments": [{"url": "s.m4s"}]}]}`
+	for _, data := range []string{flat, `{"clip_id": "clip"}`, `not json`} {
+		if _, ok := parseMasterPlaylist([]byte(data)); ok {
+			t.Errorf("%s parsed as a master.json", data)
+		}
+	}
+}
+
+func TestMasterRenditionURL(t *testing.T) {
+	master, _ := parseMasterPlaylist([]byte(masterFixture))
+	masterURL := "https://cdn.example.com/exp=1~hmac=x/sep/video/master.json?base64_init=1"
+	want := []string{
+		"https://cdn.example.com/exp=1~hmac=x/sep/parts/video/1080/playlist.json",
+		"https://cdn.example.com/exp=1~hmac=x/sep/parts/video/720/playlist.json",
+	}
+	for i, r := range master.Video {
+		if got := master.renditionURL(masterURL, r); got != want[i] {
+			t.Errorf("rendition %s: %s, want %s", r.ID, got, want[i])
+		}
+	}
+}
+
+func TestResolveMasterPlaylist(t *testing.T) {
+	playlists := map[string]string{
+		"/sep/parts/video/1080/playlist.json": `{"base_url": "../../media/", "video": [{"id": "v1080", "base_url": "1080/", "height": 1080, "segments": [{"url": "s.m4s"}]}]}`,
+		"/sep/parts/video/720/playlist.json":  `{"base_url": "../../media/", "video": [{"id": "v720", "base_url": "720/", "height": 720, "segments": [{"url": "s.m4s"}]}]}`,
+		"/sep/parts/audio/128/playlist.json":  `{"base_url": "./", "audio": [{"id": "a128", "base_url": "", "segments": [{"url": "s.m4s"}]}]}`,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch data, ok := playlists[r.URL.Path]; {
+		case r.URL.Path == "/sep/video/master.json":
+			w.Write([]byte(masterFixture))
+		case ok:
+			w.Write([]byte(data))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	data := []byte(masterFixture)
+	playlist, prefix, err := (&Downloader{Concurrent: 1}).loadPlaylist(data, srv.URL+"/sep/video/master.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prefix != "" {
+		t.Errorf("prefix %q, want none for absolute stream base URLs", prefix)
+	}
+	want := map[string]string{
+		"v1080": srv.URL + "/sep/parts/media/1080/",
+		"v720":  srv.URL + "/sep/parts/media/720/",
+		"a128":  srv.URL + "/sep/parts/audio/128/",
+	}
+	for _, s := range append(playlist.Video, playlist.Audio...) {
+		if s.BaseURL != want[s.ID] {
+			t.Errorf("stream %s base URL %s, want %s", s.ID, s.BaseURL, want[s.ID])
+		}
+		delete(want, s.ID)
+	}
+	if len(want) != 0 {
+		t.Errorf("streams missing: %v", want)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics counts what the downloads of a run do, for -metrics-addr. The
+// methods do nothing on a nil *Metrics, so call sites needn't check.
+type Metrics struct {
+	segments    atomic.Int64
+	bytes       atomic.Int64
+	retries     atomic.Int64
+	failures    atomic.Int64
+	muxes       atomic.Int64
+	muxDuration atomic.Int64 // Nanoseconds
+	inFlight    atomic.Int64
+}
+
+// segmentDone counts a downloaded segment of the given size
+func (m *Metrics) segmentDone(size int) {
+	if m == nil {
+		return
+	}
+	m.segments.Add(1)
+	m.bytes.Add(int64(size))
+}
+
+// retry counts a request that failed and is tried again
+func (m *Metrics) retry() {
+	if m != nil {
+		m.retries.Add(1)
+	}
+}
+
+// failure counts a segment that failed for good
+func (m *Metrics) failure() {
+	if m != nil {
+		m.failures.Add(1)
+	}
+}
+
+// muxDone counts an ffmpeg run that took d
+func (m *Metrics) muxDone(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.muxes.Add(1)
+	m.muxDuration.Add(int64(d))
+}
+
+// requestStarted counts a segment request in flight until the returned
+// func is called
+func (m *Metrics) requestStarted() func() {
+	if m == nil {
+		return func() {}
+	}
+	m.inFlight.Add(1)
+	return func() { m.inFlight.Add(-1) }
+}
+
+// writeTo writes the metrics in the Prometheus text exposition format
+func (m *Metrics) writeTo(w io.Writer) {
+	for _, metric := range []struct {
+		name, kind, help string
+		value            float64
+	}{
+		{"vimeo_downloader_segments_downloaded_total", "counter", "Segments downloaded.", float64(m.segments.Load())},
+		{"vimeo_downloader_bytes_downloaded_total", "counter", "Bytes of segments downloaded.", float64(m.bytes.Load())},
+		{"vimeo_downloader_retries_total", "counter", "Segment and playlist requests retried.", float64(m.retries.Load())},
+		{"vimeo_downloader_segment_failures_total", "counter", "Segments that failed after all retries.", float64(m.failures.Load())},
+		{"vimeo_downloader_muxes_total", "counter", "ffmpeg mux runs.", float64(m.muxes.Load())},
+		{"vimeo_downloader_mux_seconds_total", "counter", "Time spent muxing with ffmpeg.", time.Duration(m.muxDuration.Load()).Seconds()},
+		{"vimeo_downloader_requests_in_flight", "gauge", "Segment requests currently running.", float64(m.inFlight.Load())},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", metric.name, metric.help, metric.name, metric.kind, metric.name, metric.value)
+	}
+}
+
+// serveMetrics serves m at /metrics on addr in the background for the rest
+// of the run. Listening happens first so a bad address is reported.
+func serveMetrics(addr string, m *Metrics) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("metrics server: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m.writeTo(w)
+	})
+	go http.Serve(ln, mux)
+	infof("Serving metrics on http://%s/metrics", ln.Addr())
+	return nil
+}
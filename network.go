@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// dnsTimeout bounds a query to the -dns server
+const dnsTimeout = 5 * time.Second
+
+// ipNetwork returns the network that -force-ipv4 and -force-ipv6 restrict
+// connections to, "" for both
+func ipNetwork(forceIPv4, forceIPv6 bool) (string, error) {
+	switch {
+	case forceIPv4 && forceIPv6:
+		return "", errors.New("-force-ipv4 and -force-ipv6 cannot be used together")
+	case forceIPv4:
+		return "tcp4", nil
+	case forceIPv6:
+		return "tcp6", nil
+	}
+	return "", nil
+}
+
+// newDNSResolver returns a resolver that sends its queries to server, an IP
+// address with an optional port (53 by default), or nil for an empty server
+// so the system's resolver is used
+func newDNSResolver(server string) (*net.Resolver, error) {
+	if server == "" {
+		return nil, nil
+	}
+	addr := server
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		addr = net.JoinHostPort(strings.Trim(server, "[]"), "53")
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) == nil {
+		return nil, fmt.Errorf("invalid -dns %q, expected an IP address like 1.1.1.1 or [2606:4700:4700::1111]:53", server)
+	}
+
+	dialer := &net.Dialer{Timeout: dnsTimeout}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}, nil
+}
+
+// restrictNetwork wraps dial so TCP connections only use network, tcp4 or
+// tcp6, which also limits the DNS lookups to A or AAAA records
+func restrictNetwork(dial func(ctx context.Context, network, addr string) (net.Conn, error), network string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network == "" {
+		return dial
+	}
+	return func(ctx context.Context, n, addr string) (net.Conn, error) {
+		if n == "tcp" {
+			n = network
+		}
+		return dial(ctx, n, addr)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// OutputWriter writes a file to its destination. Nothing shows up at the
+// destination until Close succeeds, and Abort discards what was written.
+type OutputWriter interface {
+	io.WriteCloser
+	Abort() error
+}
+
+// isRemoteOutput reports whether -o names a destination that ffmpeg can't
+// write to directly, so the output is made locally and then copied there
+func isRemoteOutput(dest string) bool {
+	return strings.HasPrefix(dest, "s3://")
+}
+
+// localOutputPath turns a file:// URL into a path, leaving plain paths as
+// they are
+func localOutputPath(dest string) (string, error) {
+	if !strings.HasPrefix(dest, "file://") {
+		return dest, nil
+	}
+	u, err := url.Parse(dest)
+	if err != nil {
+		return "", fmt.Errorf("invalid output URL: %w", err)
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return "", fmt.Errorf("file:// output on host %q isn't supported", u.Host)
+	}
+	return filepath.FromSlash(u.Path), nil
+}
+
+// createOutput opens a writer for dest, chosen by its scheme: s3:// for
+// S3, anything else for a local file
+func createOutput(dest string, client *http.Client) (OutputWriter, error) {
+	if strings.HasPrefix(dest, "s3://") {
+		bucket, key, err := parseS3URL(dest)
+		if err != nil {
+			return nil, err
+		}
+		s3, err := newS3ClientFromEnv(client)
+		if err != nil {
+			return nil, err
+		}
+		return s3.createMultipartWriter(bucket, key)
+	}
+	path, err := localOutputPath(dest)
+	if err != nil {
+		return nil, err
+	}
+	return createFileOutput(path)
+}
+
+// saveOutput writes data to dest, e.g. a sidecar file next to the output
+func saveOutput(dest string, data []byte, client *http.Client) error {
+	w, err := createOutput(dest, client)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+// uploadOutput copies the local file at path to dest
+func uploadOutput(path, dest string, client *http.Client) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w, err := createOutput(dest, client)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, f); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+// fileOutput writes to a temporary file next to the destination, renamed
+// into place on Close so a partial file is never left under its name
+type fileOutput struct {
+	f    *os.File
+	path string
+}
+
+func createFileOutput(path string) (*fileOutput, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.part")
+	if err != nil {
+		return nil, err
+	}
+	return &fileOutput{f: f, path: path}, nil
+}
+
+func (o *fileOutput) Write(p []byte) (int, error) {
+	return o.f.Write(p)
+}
+
+func (o *fileOutput) Close() error {
+	if err := o.f.Close(); err != nil {
+		os.Remove(o.f.Name())
+		return err
+	}
+	// CreateTemp makes the file private, give it the usual permissions
+	os.Chmod(o.f.Name(), 0644)
+	if err := os.Rename(o.f.Name(), o.path); err != nil {
+		os.Remove(o.f.Name())
+		return err
+	}
+	return nil
+}
+
+func (o *fileOutput) Abort() error {
+	o.f.Close()
+	return os.Remove(o.f.Name())
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// PlayerConfig is the subset of Vimeo's player config JSON
+// (https://player.vimeo.com/video/<id>/config) used to locate the DASH
+// playlist and describe the video
+type PlayerConfig struct {
+	Request struct {
+		Files struct {
+			Dash struct {
+				DefaultCDN string               `json:"default_cdn"`
+				CDNs       map[string]PlayerCDN `json:"cdns"`
+			} `json:"dash"`
+		} `json:"files"`
+		DRM        json.RawMessage `json:"drm"` // Present for DRM-protected videos
+		TextTracks []TextTrack     `json:"text_tracks"`
+	} `json:"request"`
+	Video struct {
+		ID    int64  `json:"id"`
+		Title string `json:"title"`
+		URL   string `json:"url"`
+		Owner struct {
+			Name string `json:"name"`
+		} `json:"owner"`
+		Thumbs map[string]string `json:"thumbs"` // Keyed by width, plus "base"
+	} `json:"video"`
+}
+
+// PlayerCDN is one CDN entry of the player config's DASH files
+type PlayerCDN struct {
+	URL string `json:"url"`
+}
+
+// parsePlayerConfig parses data as a player config, reporting ok=false when
+// the JSON isn't a config with DASH files (e.g. it is a playlist itself)
+func parsePlayerConfig(data []byte) (config *PlayerConfig, ok bool) {
+	config = &PlayerConfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, false
+	}
+	if len(config.Request.Files.Dash.CDNs) == 0 {
+		return nil, false
+	}
+	return config, true
+}
+
+// PlaylistURL returns the DASH playlist URL of the default CDN, or of any
+// CDN when the default isn't listed
+func (c *PlayerConfig) PlaylistURL() (string, error) {
+	dash := c.Request.Files.Dash
+	if cdn, ok := dash.CDNs[dash.DefaultCDN]; ok && cdn.URL != "" {
+		return cdn.URL, nil
+	}
+	for _, cdn := range dash.CDNs {
+		if cdn.URL != "" {
+			return cdn.URL, nil
+		}
+	}
+	return "", fmt.Errorf("player config has no DASH playlist URL")
+}
+
+// ThumbnailURL returns the widest thumbnail in the config, or "" if none
+func (c *PlayerConfig) ThumbnailURL() string {
+	best, bestWidth := "", -1
+	for key, u := range c.Video.Thumbs {
+		width, err := strconv.Atoi(key)
+		if err != nil || u == "" {
+			continue
+		}
+		if width > bestWidth {
+			best, bestWidth = u, width
+		}
+	}
+	return best
+}
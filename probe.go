@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// probeStreams prints the technical details of the playlist's streams for
+// -probe as a table, only those at videoIndex and audioIndex when one is
+// given (not -1)
+func probeStreams(playlist *Playlist, videoIndex, audioIndex int) error {
+	type probed struct {
+		kind   StreamKind
+		index  int
+		stream *Stream
+	}
+	var streams []probed
+	add := func(kind StreamKind, list []Stream, index int) error {
+		if index != -1 {
+			stream, err := streamAtIndex(list, index)
+			if err != nil {
+				return fmt.Errorf("-%s-index %w", kind, err)
+			}
+			streams = append(streams, probed{kind, index, stream})
+			return nil
+		}
+		for i := range list {
+			streams = append(streams, probed{kind, i, &list[i]})
+		}
+		return nil
+	}
+	// Selecting only one kind of stream leaves the other out
+	if videoIndex != -1 || audioIndex == -1 {
+		if err := add(VideoStream, playlist.Video, videoIndex); err != nil {
+			return err
+		}
+	}
+	if audioIndex != -1 || videoIndex == -1 {
+		if err := add(AudioStream, playlist.Audio, audioIndex); err != nil {
+			return err
+		}
+	}
+
+	var table strings.Builder
+	w := tabwriter.NewWriter(&table, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STREAM\tID\tRESOLUTION\tFPS\tCODEC\tPROFILE\tLEVEL\tAVG KBPS\tPEAK KBPS\tSEGMENTS\tMAX SEG\tDURATION\tSIZE")
+	for _, p := range streams {
+		s := p.stream
+		resolution, fps := "-", "-"
+		if s.Width > 0 && s.Height > 0 {
+			resolution = fmt.Sprintf("%dx%d", s.Width, s.Height)
+		}
+		if s.Framerate > 0 {
+			fps = strconv.FormatFloat(s.Framerate, 'f', -1, 64)
+		}
+		profile, level := codecProfile(s.Codecs)
+		size := "-"
+		if bytes := estimateStreamSize(s); bytes > 0 {
+			size = formatSize(bytes)
+		}
+		fmt.Fprintf(w, "%s [%d]\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%.2fs\t%.2fs\t%s\n",
+			p.kind, p.index, orDash(s.ID), resolution, fps, orDash(s.Codecs), orDash(profile), orDash(level),
+			kbps(s.AvgBitrate), kbps(s.Bitrate), len(s.Segments), s.MaxSegmentDuration, s.Duration, size)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if len(streams) == 0 {
+		resultf("No streams to probe")
+		return nil
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(table.String(), "\n"), "\n") {
+		resultf("%s", strings.TrimRight(line, " "))
+	}
+	return nil
+}
+
+func kbps(bitrate int) string {
+	if bitrate <= 0 {
+		return "-"
+	}
+	return strconv.Itoa(bitrate / 1000)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// avcProfiles names the profile_idc values of H.264
+var avcProfiles = map[int]string{
+	66:  "Baseline",
+	77:  "Main",
+	88:  "Extended",
+	100: "High",
+	110: "High 10",
+	122: "High 4:2:2",
+	244: "High 4:4:4",
+}
+
+// aacProfiles names the MPEG-4 audio object types of mp4a.40.<type>
+var aacProfiles = map[string]string{
+	"2":  "AAC-LC",
+	"5":  "HE-AAC",
+	"29": "HE-AACv2",
+	"34": "MP3",
+}
+
+// codecProfile derives the profile and level from an RFC 6381 codecs
+// string, as far as it says. The first of several codecs is used.
+func codecProfile(codecs string) (profile, level string) {
+	codec, _, _ := strings.Cut(codecs, ",")
+	parts := strings.Split(strings.TrimSpace(codec), ".")
+	switch parts[0] {
+	case "avc1", "avc3":
+		// avc1.PPCCLL: profile, constraint flags, and level in hex
+		if len(parts) < 2 || len(parts[1]) != 6 {
+			return "", ""
+		}
+		p, err1 := strconv.ParseUint(parts[1][0:2], 16, 8)
+		l, err2 := strconv.ParseUint(parts[1][4:6], 16, 8)
+		if err1 != nil || err2 != nil {
+			return "", ""
+		}
+		profile = avcProfiles[int(p)]
+		if profile == "" {
+			profile = strconv.FormatUint(p, 10)
+		}
+		return profile, strconv.FormatFloat(float64(l)/10, 'f', 1, 64)
+	case "hvc1", "hev1":
+		// hvc1.P.C.TL.B: profile, compatibility, tier and level times 30
+		if len(parts) < 4 || len(parts[3]) < 2 {
+			return "", ""
+		}
+		switch strings.TrimLeft(parts[1], "ABC") {
+		case "1":
+			profile = "Main"
+		case "2":
+			profile = "Main 10"
+		case "3":
+			profile = "Main Still Picture"
+		default:
+			profile = parts[1]
+		}
+		tier := parts[3][:1]
+		if l, err := strconv.Atoi(parts[3][1:]); err == nil && (tier == "L" || tier == "H") {
+			level = strconv.FormatFloat(float64(l)/30, 'f', 1, 64)
+			if tier == "H" {
+				level += " High tier"
+			}
+		}
+		return profile, level
+	case "av01":
+		// av01.P.LLT.DD: profile, level index and tier, bit depth
+		if len(parts) < 3 || len(parts[2]) < 3 {
+			return "", ""
+		}
+		profile = map[string]string{"0": "Main", "1": "High", "2": "Professional"}[parts[1]]
+		if l, err := strconv.Atoi(parts[2][:2]); err == nil {
+			level = fmt.Sprintf("%d.%d", 2+l/4, l%4)
+			if parts[2][2] == 'H' {
+				level += " High tier"
+			}
+		}
+		if profile != "" && len(parts) > 3 {
+			profile += " " + strings.TrimLeft(parts[3], "0") + "-bit"
+		}
+		return profile, level
+	case "vp09":
+		// vp09.PP.LL.DD: profile, level times 10, bit depth
+		if len(parts) < 3 {
+			return "", ""
+		}
+		p, err1 := strconv.Atoi(parts[1])
+		l, err2 := strconv.Atoi(parts[2])
+		if err1 != nil || err2 != nil {
+			return "", ""
+		}
+		return strconv.Itoa(p), strconv.FormatFloat(float64(l)/10, 'f', -1, 64)
+	case "mp4a":
+		if len(parts) == 3 && parts[1] == "40" {
+			return aacProfiles[parts[2]], ""
+		}
+	}
+	return "", ""
+}
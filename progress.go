@@ -0,0 +1,391 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Progress modes for -progress
+const (
+	ProgressBar  = "bar"
+	ProgressJSON = "json"
+	ProgressNone = "none"
+)
+
+// plainProgressInterval is how often progress is printed when the output
+// isn't a terminal, where each update is a new line rather than a redraw
+const plainProgressInterval = 10 * time.Second
+
+// streamLabels names the streams in the progress display
+var streamLabels = [2]string{VideoStream: "Video", AudioStream: "Audio"}
+
+// StreamProgress is the state of one stream in a JSON progress update
+type StreamProgress struct {
+	Done  int   `json:"done"`
+	Total int   `json:"total"`
+	Bytes int64 `json:"bytes"`
+}
+
+// ProgressUpdate is one line of -progress json output. Speed is in bytes
+// per second and ETA in seconds, both omitted until a rate is known.
+type ProgressUpdate struct {
+	Video *StreamProgress `json:"video,omitempty"`
+	Audio *StreamProgress `json:"audio,omitempty"`
+	Bytes int64           `json:"bytes"`
+	Speed *float64        `json:"speed,omitempty"`
+	ETA   *float64        `json:"eta,omitempty"`
+}
+
+// newJSONProgress returns a ProgressFunc that writes a newline-delimited
+// ProgressUpdate to w each time all of the given streams have reported
+func newJSONProgress(w io.Writer, kinds ...StreamKind) ProgressFunc {
+	var state [2]StreamProgress
+	var seen [2]bool
+	rate := &rateMeter{window: 5 * time.Second}
+	enc := json.NewEncoder(w)
+	return func(stream StreamKind, c, t int, b int64) {
+		state[stream] = StreamProgress{Done: c, Total: t, Bytes: b}
+		seen[stream] = true
+		// The reporter calls once per stream, emit after the last one
+		if stream != kinds[len(kinds)-1] {
+			return
+		}
+		for _, k := range kinds {
+			if !seen[k] {
+				return
+			}
+		}
+
+		var update ProgressUpdate
+		var estimated int64
+		for _, k := range kinds {
+			s := state[k]
+			if k == VideoStream {
+				update.Video = &s
+			} else {
+				update.Audio = &s
+			}
+			update.Bytes += s.Bytes
+			estimated += estimateTotalBytes(s.Done, s.Total, s.Bytes)
+		}
+		if speed, ok := rate.add(time.Now(), update.Bytes); ok {
+			update.Speed = &speed
+			if speed > 0 {
+				eta := float64(estimated-update.Bytes) / speed
+				update.ETA = &eta
+			}
+		}
+		enc.Encode(update)
+	}
+}
+
+// newConsoleProgress returns a ProgressFunc that shows the progress of the
+// given streams on out. On a terminal it redraws a line per stream and a
+// total line with the combined speed and estimated time remaining, cut to
+// the terminal's width. Otherwise it prints a plain line every
+// plainProgressInterval and when the streams are complete.
+func newConsoleProgress(out *os.File, kinds ...StreamKind) ProgressFunc {
+	live := isTerminal(out) && enableTerminalEscapes(out)
+	var state [2]StreamProgress
+	var seen [2]bool
+	var drawn int // Lines of the last redraw
+	var lastPrint time.Time
+	rate := &rateMeter{window: 5 * time.Second}
+	return func(stream StreamKind, c, t int, b int64) {
+		state[stream] = StreamProgress{Done: c, Total: t, Bytes: b}
+		seen[stream] = true
+		// The reporter calls once per stream, draw after the last one
+		if stream != kinds[len(kinds)-1] {
+			return
+		}
+		complete := true
+		var downloaded, estimated int64
+		for _, k := range kinds {
+			if !seen[k] {
+				return
+			}
+			s := state[k]
+			complete = complete && s.Done == s.Total
+			downloaded += s.Bytes
+			estimated += estimateTotalBytes(s.Done, s.Total, s.Bytes)
+		}
+
+		speed, ok := rate.add(time.Now(), downloaded)
+		speedText, etaText := "-- MB/s", "ETA --:--"
+		if ok {
+			speedText = fmt.Sprintf("%.1f MB/s", speed/(1024*1024))
+			if speed > 0 {
+				etaText = "ETA " + formatETA(time.Duration(float64(estimated-downloaded)/speed*float64(time.Second)))
+			}
+		}
+
+		if !live {
+			if !complete && time.Since(lastPrint) < plainProgressInterval {
+				return
+			}
+			lastPrint = time.Now()
+			var parts []string
+			for _, k := range kinds {
+				s := state[k]
+				parts = append(parts, fmt.Sprintf("%s: %d/%d (%.1f%%)", streamLabels[k], s.Done, s.Total, percent(s.Done, s.Total)))
+			}
+			parts = append(parts, formatSize(downloaded), speedText, etaText)
+			fmt.Fprintf(out, "  %s\n", strings.Join(parts, " | "))
+			return
+		}
+
+		width := consoleWidth(out)
+		var lines []string
+		for _, k := range kinds {
+			lines = append(lines, progressLine(streamLabels[k], state[k], width))
+		}
+		lines = append(lines, fmt.Sprintf("  Total  %s | %s | %s", formatSize(downloaded), speedText, etaText))
+		drawn = drawLines(out, lines, drawn, width)
+	}
+}
+
+// consoleWidth returns the width of the terminal out is connected to, else
+// $COLUMNS, else 80
+func consoleWidth(out *os.File) int {
+	width := terminalWidth(out)
+	if width <= 0 {
+		width, _ = strconv.Atoi(os.Getenv("COLUMNS"))
+	}
+	if width <= 0 {
+		width = 80
+	}
+	return width
+}
+
+// drawLines draws lines over the drawn lines of the previous call and
+// returns how many it drew, for the next one. Lines are cut one short of
+// the width so the cursor never wraps, which would throw the count off.
+func drawLines(w io.Writer, lines []string, drawn, width int) int {
+	var frame strings.Builder
+	if drawn > 1 {
+		fmt.Fprintf(&frame, "\x1b[%dA", drawn-1)
+	}
+	for i, line := range lines {
+		if i > 0 {
+			frame.WriteString("\n")
+		}
+		frame.WriteString("\r")
+		frame.WriteString(truncateLine(line, width-1))
+		frame.WriteString("\x1b[K") // Clear what's left of the previous line
+	}
+	if len(lines) < drawn {
+		frame.WriteString("\x1b[J") // Clear the lines no longer drawn
+	}
+	io.WriteString(w, frame.String())
+	return len(lines)
+}
+
+// clearLines erases the drawn lines of drawLines, leaving the cursor where
+// the first of them started
+func clearLines(w io.Writer, drawn int) {
+	if drawn > 1 {
+		fmt.Fprintf(w, "\x1b[%dA", drawn-1)
+	}
+	if drawn > 0 {
+		io.WriteString(w, "\r\x1b[J")
+	}
+}
+
+// progressLine renders a stream's progress as a bar followed by counts,
+// dropping the bar when width leaves no room for it
+func progressLine(label string, s StreamProgress, width int) string {
+	// The count is padded so the bar keeps its size as it fills
+	digits := len(strconv.Itoa(s.Total))
+	stats := fmt.Sprintf("%*d/%d %5.1f%%  %s", digits, s.Done, s.Total, percent(s.Done, s.Total), formatSize(s.Bytes))
+	prefix := fmt.Sprintf("  %-5s  ", label)
+	barWidth := min(width-1-len(prefix)-len(stats)-len("[]  "), 40)
+	if barWidth < 10 {
+		return prefix + stats
+	}
+	filled := 0
+	if s.Total > 0 {
+		filled = barWidth * s.Done / s.Total
+	}
+	return prefix + "[" + strings.Repeat("#", filled) + strings.Repeat("-", barWidth-filled) + "]  " + stats
+}
+
+// truncateLine cuts line to width columns, marking the cut with an
+// ellipsis. Progress lines are ASCII, so bytes are columns.
+func truncateLine(line string, width int) string {
+	if len(line) <= width {
+		return line
+	}
+	if width <= 3 {
+		return line[:max(width, 0)]
+	}
+	return line[:width-3] + "..."
+}
+
+// batchProgress shows the videos of a -parallel-videos batch together, a
+// line per running video and an overall line. Log messages are written
+// through it so they scroll by above the progress instead of tearing it.
+type batchProgress struct {
+	mu       sync.Mutex
+	out      *os.File
+	live     bool
+	videos   []batchVideo
+	drawn    int
+	lastDraw time.Time
+	rate     *rateMeter
+}
+
+type batchVideo struct {
+	label   string
+	state   batchState
+	streams [2]StreamProgress
+}
+
+type batchState int
+
+const (
+	batchQueued batchState = iota
+	batchRunning
+	batchDone
+	batchFailed
+)
+
+func newBatchProgress(out *os.File, entries []BatchEntry) *batchProgress {
+	p := &batchProgress{
+		out:    out,
+		live:   isTerminal(out) && enableTerminalEscapes(out),
+		videos: make([]batchVideo, len(entries)),
+		rate:   &rateMeter{window: 5 * time.Second},
+	}
+	for i, entry := range entries {
+		p.videos[i].label = entry.URL
+		if entry.OutputFile != "" {
+			p.videos[i].label = entry.OutputFile
+		}
+	}
+	return p
+}
+
+// start marks the video at index as running
+func (p *batchProgress) start(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.videos[index].state = batchRunning
+	p.draw(true)
+}
+
+// finish marks the video at index as done, or failed if err is set
+func (p *batchProgress) finish(index int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.videos[index].state = batchDone
+	if err != nil {
+		p.videos[index].state = batchFailed
+	}
+	p.draw(true)
+}
+
+// track returns the ProgressFunc for a download of the given streams of
+// the video at index, which is labelled with its output file from now on
+func (p *batchProgress) track(index int, label string, kinds ...StreamKind) ProgressFunc {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.videos[index].label = label
+	// A fallback downloads the video again, the audio is kept
+	for _, k := range kinds {
+		p.videos[index].streams[k] = StreamProgress{}
+	}
+	return func(stream StreamKind, c, t int, b int64) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.videos[index].streams[stream] = StreamProgress{Done: c, Total: t, Bytes: b}
+		p.draw(false)
+	}
+}
+
+// stop erases the progress, once the batch is done
+func (p *batchProgress) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.live {
+		clearLines(p.out, p.drawn)
+		p.drawn = 0
+	}
+}
+
+// draw shows the progress, at most every 500ms on a terminal and every
+// plainProgressInterval otherwise unless force is set. p.mu must be held.
+func (p *batchProgress) draw(force bool) {
+	interval := plainProgressInterval
+	if p.live {
+		interval = 500 * time.Millisecond
+	}
+	if time.Since(p.lastDraw) < interval && (!force || !p.live) {
+		return
+	}
+	p.lastDraw = time.Now()
+
+	var counts [4]int
+	var total int64
+	var running []string
+	for i, v := range p.videos {
+		counts[v.state]++
+		var done, segments int
+		for _, s := range v.streams {
+			done += s.Done
+			segments += s.Total
+			total += s.Bytes
+		}
+		if v.state == batchRunning {
+			running = append(running, fmt.Sprintf("[%d/%d] %5.1f%%  %s  %s",
+				i+1, len(p.videos), percent(done, segments), formatSize(v.streams[VideoStream].Bytes+v.streams[AudioStream].Bytes), v.label))
+		}
+	}
+	speedText := "-- MB/s"
+	if speed, ok := p.rate.add(time.Now(), total); ok {
+		speedText = fmt.Sprintf("%.1f MB/s", speed/(1024*1024))
+	}
+	overall := fmt.Sprintf("%d/%d done, %d failed, %d running | %s | %s",
+		counts[batchDone], len(p.videos), counts[batchFailed], counts[batchRunning], formatSize(total), speedText)
+
+	if !p.live {
+		fmt.Fprintf(p.out, "  Batch: %s\n", overall)
+		return
+	}
+	lines := make([]string, 0, len(running)+1)
+	for _, line := range running {
+		lines = append(lines, "  "+line)
+	}
+	lines = append(lines, "  Overall  "+overall)
+	p.drawn = drawLines(p.out, lines, p.drawn, consoleWidth(p.out))
+}
+
+// writer returns a writer for log messages to w, which erases the progress
+// before each message and draws it again below
+func (p *batchProgress) writer(w io.Writer) io.Writer {
+	return &batchLogWriter{p: p, w: w}
+}
+
+type batchLogWriter struct {
+	p *batchProgress
+	w io.Writer
+}
+
+func (lw *batchLogWriter) Write(b []byte) (int, error) {
+	p := lw.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.live || p.drawn == 0 {
+		return lw.w.Write(b)
+	}
+	clearLines(p.out, p.drawn)
+	p.drawn = 0
+	n, err := lw.w.Write(b)
+	p.draw(true)
+	return n, err
+}
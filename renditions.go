@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// renditionAudio is the audio of an -all-qualities run, downloaded with the
+// first rendition and muxed into the others
+type renditionAudio struct {
+	dir      string            // Temp directory holding file, "" until made
+	file     string            // Downloaded audio, "" until a rendition got it
+	segments []ManifestSegment // Its segments, for -manifest
+}
+
+// RenditionResult is the outcome of one rendition of an -all-qualities run
+type RenditionResult struct {
+	Stream *Stream
+	Output string
+	Err    error
+	Hook   HookResult
+}
+
+// downloadAllQualities downloads every video rendition of src, each muxed
+// with the best audio into its own file named after the resolution. The
+// renditions are downloaded one after another, so the -c limit holds for
+// the whole run, and share the audio, which is only downloaded once.
+func downloadAllQualities(opts Options, downloader *Downloader, src *playlistSource) error {
+	if opts.OutputFile == stdoutOutput {
+		return errors.New("-all-qualities writes one file per rendition and can't be used with -o -")
+	}
+	if len(src.playlist.Video) == 0 {
+		return errors.New("-all-qualities given but the playlist has no video streams")
+	}
+
+	var bestAudio *Stream
+	if len(src.playlist.Audio) > 0 {
+		bestAudio = &src.playlist.Audio[0]
+	}
+	container, err := resolveContainer(opts.Format, opts.OutputFile, &src.playlist.Video[0], bestAudio)
+	if err != nil {
+		return err
+	}
+	base := strings.TrimSuffix(opts.OutputFile, filepath.Ext(opts.OutputFile))
+	if base == "" {
+		title := opts.Title
+		if title == "" && src.config != nil {
+			title = src.config.Video.Title
+		}
+		base = defaultOutputBase(title, src.playlist.ClipID)
+	}
+
+	outputs := renditionOutputs(base, container.Name, src.playlist.Video)
+	templated := opts.OutputFile == "" && opts.OutputTemplate != ""
+	if templated {
+		if outputs, err = templateRenditionOutputs(opts.OutputTemplate, container.Name, &src.playlist, bestAudio); err != nil {
+			return err
+		}
+	}
+	audio := &renditionAudio{}
+	defer func() {
+		if audio.dir != "" && !opts.KeepTemp {
+			os.RemoveAll(audio.dir)
+		}
+	}()
+	results := make([]RenditionResult, len(src.playlist.Video))
+	for i := range src.playlist.Video {
+		stream := &src.playlist.Video[i]
+		infof("\n=== Rendition %d/%d: %dx%d -> %s ===", i+1, len(results), stream.Width, stream.Height, outputs[i])
+
+		renditionOpts := opts
+		renditionOpts.OutputFile = outputs[i]
+		renditionOpts.VideoIndex = i
+		// Falling back would only duplicate a lower rendition
+		renditionOpts.NoFallback = true
+		// The summary needs the finished files
+		renditionOpts.muxQueue = nil
+		renditionOpts.sharedAudio = audio
+		renditionOpts.hook = &results[i].Hook
+		if opts.ManifestFile != "" {
+			ext := filepath.Ext(opts.ManifestFile)
+			suffix := strings.TrimPrefix(strings.TrimSuffix(outputs[i], "."+container.Name), base)
+			if templated {
+				suffix = "_" + strings.TrimSuffix(filepath.Base(outputs[i]), filepath.Ext(outputs[i]))
+			}
+			renditionOpts.ManifestFile = strings.TrimSuffix(opts.ManifestFile, ext) + suffix + ext
+		}
+		if templated && !opts.DryRun && !opts.CheckURLs {
+			if err := os.MkdirAll(filepath.Dir(outputs[i]), 0755); err != nil {
+				return fmt.Errorf("creating output directory: %w", err)
+			}
+		}
+		// -max-size applies to each rendition
+		downloader.downloaded.Store(0)
+		_, err := downloadFromPlaylist(renditionOpts, downloader, src)
+		if err != nil {
+			errorf("%dx%d: %v", stream.Width, stream.Height, err)
+		}
+		results[i].Stream, results[i].Output, results[i].Err = stream, outputs[i], err
+	}
+
+	// A batch entry reports the first failed hook of its renditions
+	if opts.hook != nil {
+		for _, r := range results {
+			if r.Hook.Ran() && !opts.hook.Failed() {
+				*opts.hook = r.Hook
+			}
+		}
+	}
+
+	return printRenditionSummary(results)
+}
+
+// renditionOutputs names an output per stream after its height, adding the
+// bitrate when two renditions share a height
+func renditionOutputs(base, ext string, streams []Stream) []string {
+	heights := make(map[int]int)
+	for _, s := range streams {
+		heights[s.Height]++
+	}
+	outputs := make([]string, len(streams))
+	for i, s := range streams {
+		name := fmt.Sprintf("%s_%dp", base, s.Height)
+		if heights[s.Height] > 1 {
+			name += fmt.Sprintf("_%dk", s.Bitrate/1000)
+		}
+		outputs[i] = name + "." + ext
+	}
+	return outputs
+}
+
+// templateRenditionOutputs names an output per video stream of playlist
+// after -output-template, which must tell them apart
+func templateRenditionOutputs(template, ext string, playlist *Playlist, audio *Stream) ([]string, error) {
+	outputs := make([]string, len(playlist.Video))
+	seen := make(map[string]bool)
+	for i := range playlist.Video {
+		output, err := expandOutputTemplate(template, playlist.ClipID, i, &playlist.Video[i], audio)
+		if err != nil {
+			return nil, err
+		}
+		if filepath.Ext(output) == "" {
+			output += "." + ext
+		}
+		if seen[output] {
+			return nil, fmt.Errorf("-output-template names two renditions %s, add {bitrate} or {codec} to tell them apart", output)
+		}
+		seen[output] = true
+		outputs[i] = output
+	}
+	return outputs, nil
+}
+
+// printRenditionSummary prints a table of the produced files and returns an
+// error if any rendition failed
+func printRenditionSummary(results []RenditionResult) error {
+	var b strings.Builder
+	failed := 0
+	fmt.Fprintf(&b, "\nRenditions:\n")
+	for _, r := range results {
+		status := "FAILED: " + fmt.Sprint(r.Err)
+		if r.Err == nil {
+			status = "unknown size"
+			if info, err := os.Stat(r.Output); err == nil {
+				status = formatSize(info.Size())
+			}
+		} else {
+			failed++
+		}
+		if r.Hook.Ran() {
+			status += ", " + r.Hook.String()
+		}
+		fmt.Fprintf(&b, "  %-10s %-40s %s\n", fmt.Sprintf("%dx%d", r.Stream.Width, r.Stream.Height), r.Output, status)
+	}
+	fmt.Fprintf(&b, "%d of %d renditions downloaded", len(results)-failed, len(results))
+	resultf("%s", b.String())
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d renditions failed", failed, len(results))
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// countingHandler is segmentHandler counting the requests for each stream
+type countingHandler struct {
+	mu       sync.Mutex
+	requests map[string]int
+}
+
+func (h *countingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	h.mu.Lock()
+	h.requests[id]++
+	h.mu.Unlock()
+	segmentHandler(nil).ServeHTTP(w, r)
+}
+
+func renditionsSource(baseURL string) *playlistSource {
+	v1080, v720, audio := testStream("v1080", 3), testStream("v720", 3), testStream("a", 3)
+	v1080.Width, v1080.Height, v1080.Codecs = 1920, 1080, "avc1.640028"
+	v720.Width, v720.Height, v720.Codecs = 1280, 720, "avc1.64001f"
+	audio.Codecs = "mp4a.40.2"
+	return &playlistSource{
+		playlist:      Playlist{ClipID: "clip", Video: []Stream{v1080, v720}, Audio: []Stream{audio}},
+		baseURLPrefix: baseURL + "/",
+	}
+}
+
+func TestDownloadAllQualitiesSharesAudio(t *testing.T) {
+	fakeFFmpeg(t, `echo muxed > "$last"`)
+	handler := &countingHandler{requests: make(map[string]int)}
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	opts := testOptions(t)
+	dir := t.TempDir()
+	opts.OutputFile = filepath.Join(dir, "video.mp4")
+	if err := downloadAllQualities(opts, &Downloader{Concurrent: 2}, renditionsSource(srv.URL)); err != nil {
+		t.Fatalf("downloadAllQualities: %v", err)
+	}
+	for _, name := range []string{"video_1080p.mp4", "video_720p.mp4"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("rendition output: %v", err)
+		}
+	}
+	if got := handler.requests["a"]; got != 3 {
+		t.Errorf("%d audio segment requests, want 3 for one download", got)
+	}
+	if got := handler.requests["v1080"] + handler.requests["v720"]; got != 6 {
+		t.Errorf("%d video segment requests, want 6", got)
+	}
+	// The shared audio goes with the run
+	if entries, _ := os.ReadDir(opts.TempDir); len(entries) != 0 {
+		t.Errorf("temp files left behind: %v", entries)
+	}
+}
+
+func TestDownloadAllQualitiesMaxSizePerRendition(t *testing.T) {
+	fakeFFmpeg(t, `echo muxed > "$last"`)
+	srv := httptest.NewServer(segmentHandler(nil))
+	defer srv.Close()
+
+	src := renditionsSource(srv.URL)
+	first := estimateStreamSize(&src.playlist.Video[0]) + estimateStreamSize(&src.playlist.Audio[0])
+	opts := testOptions(t)
+	opts.OutputFile = filepath.Join(t.TempDir(), "video.mp4")
+	// Room for the largest rendition and the audio, not for all of them
+	d := &Downloader{Concurrent: 1, MaxSize: first}
+	if err := downloadAllQualities(opts, d, src); err != nil {
+		t.Errorf("downloadAllQualities: %v", err)
+	}
+
+	d = &Downloader{Concurrent: 1, MaxSize: first - 1}
+	if err := downloadAllQualities(opts, d, src); err == nil {
+		t.Error("downloadAllQualities succeeded past -max-size")
+	}
+}
+
+func TestDownloadAllQualitiesRejectsStdout(t *testing.T) {
+	opts := testOptions(t)
+	opts.OutputFile = stdoutOutput
+	err := downloadAllQualities(opts, &Downloader{Concurrent: 1}, renditionsSource("http://unused"))
+	if err == nil {
+		t.Errorf("downloadAllQualities with -o -: %v, want an error", err)
+	}
+}
+
+func TestRenditionOutputs(t *testing.T) {
+	streams := []Stream{{Height: 1080, Bitrate: 5000000}, {Height: 720, Bitrate: 3000000}, {Height: 720, Bitrate: 2000000}}
+	want := []string{"out_1080p.mp4", "out_720p_3000k.mp4", "out_720p_2000k.mp4"}
+	got := renditionOutputs("out", "mp4", streams)
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("output %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
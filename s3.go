@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3PartSize is the size of the parts of a multipart upload, which is how
+// much of the output is held in memory. S3 allows 10,000 parts, so this
+// caps an upload at about 160 GB.
+const s3PartSize = 16 * 1024 * 1024
+
+// s3Client makes requests to S3, or an S3-compatible service, signed with
+// AWS Signature Version 4
+type s3Client struct {
+	client       *http.Client
+	endpoint     *url.URL // Custom endpoint, nil for AWS
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// newS3ClientFromEnv configures S3 the way the AWS CLI does, from
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN, AWS_REGION
+// (or AWS_DEFAULT_REGION), and AWS_ENDPOINT_URL_S3 (or AWS_ENDPOINT_URL)
+// for other S3-compatible services
+func newS3ClientFromEnv(client *http.Client) (*s3Client, error) {
+	c := &s3Client{
+		client:       client,
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		region:       firstEnv("AWS_REGION", "AWS_DEFAULT_REGION"),
+	}
+	if c.accessKey == "" || c.secretKey == "" {
+		return nil, errors.New("s3:// output needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	if c.region == "" {
+		c.region = "us-east-1"
+	}
+	if endpoint := firstEnv("AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL"); endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid S3 endpoint %q", endpoint)
+		}
+		c.endpoint = u
+	}
+	return c, nil
+}
+
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// parseS3URL splits s3://bucket/key
+func parseS3URL(dest string) (bucket, key string, err error) {
+	bucket, key, _ = strings.Cut(strings.TrimPrefix(dest, "s3://"), "/")
+	if bucket == "" || key == "" || strings.HasSuffix(key, "/") {
+		return "", "", fmt.Errorf("invalid S3 output %q, expected s3://bucket/key", dest)
+	}
+	return bucket, key, nil
+}
+
+// objectURL returns the URL of an object. AWS uses virtual-hosted style,
+// custom endpoints path style, which S3-compatible services all accept.
+func (c *s3Client) objectURL(bucket, key string, query url.Values) *url.URL {
+	u := &url.URL{Scheme: "https", Host: bucket + ".s3." + c.region + ".amazonaws.com", Path: "/" + key}
+	if c.endpoint != nil {
+		u = &url.URL{Scheme: c.endpoint.Scheme, Host: c.endpoint.Host, Path: strings.TrimSuffix(c.endpoint.Path, "/") + "/" + bucket + "/" + key}
+	}
+	u.RawPath = awsURIEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+	return u
+}
+
+// do sends a signed request and returns the response body and headers,
+// failing on anything but a 2xx status
+func (c *s3Client) do(method string, u *url.URL, body []byte) ([]byte, http.Header, error) {
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	c.sign(req, body, time.Now().UTC())
+
+	start := time.Now()
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, nil, redactURLError(err)
+	}
+	defer resp.Body.Close()
+	logger.Debug(method, "url", redactURL(u.String()), "status", resp.StatusCode, "bytes", len(body), "duration", time.Since(start))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, nil, newHTTPError(resp, u.String())
+	}
+	data, err := io.ReadAll(resp.Body)
+	return data, resp.Header, err
+}
+
+// sign adds the AWS Signature Version 4 headers to req
+func (c *s3Client) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+
+	var names []string
+	for name := range req.Header {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, strings.TrimSpace(req.Header.Get(name)))
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	for _, part := range []string{c.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+	// net/http sends req.Host, not the header
+	req.Header.Del("Host")
+	req.Host = req.URL.Host
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// awsURIEncode percent-encodes everything but the unreserved characters,
+// and "/" unless encodeSlash, as Signature Version 4 requires
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQuery encodes query sorted by key, which is also a valid query
+// string to send
+func canonicalQuery(query url.Values) string {
+	var pairs []string
+	for key, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, awsURIEncode(key, true)+"="+awsURIEncode(value, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// s3Error is the error document S3 can send with a 200 status for
+// CompleteMultipartUpload
+type s3Error struct {
+	XMLName xml.Name
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// s3MultipartWriter uploads what is written to it in parts, so at most one
+// part is held in memory
+type s3MultipartWriter struct {
+	c        *s3Client
+	bucket   string
+	key      string
+	uploadID string
+	buf      []byte
+	parts    []s3CompletedPart
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// createMultipartWriter starts a multipart upload to bucket/key
+func (c *s3Client) createMultipartWriter(bucket, key string) (*s3MultipartWriter, error) {
+	body, _, err := c.do("POST", c.objectURL(bucket, key, url.Values{"uploads": {""}}), nil)
+	if err != nil {
+		return nil, fmt.Errorf("starting S3 upload: %w", err)
+	}
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(body, &result); err != nil || result.UploadID == "" {
+		return nil, fmt.Errorf("starting S3 upload: unexpected response %q", truncate(string(body), 200))
+	}
+	return &s3MultipartWriter{c: c, bucket: bucket, key: key, uploadID: result.UploadID}, nil
+}
+
+func (w *s3MultipartWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if w.buf == nil {
+			w.buf = make([]byte, 0, s3PartSize)
+		}
+		chunk := min(len(p), s3PartSize-len(w.buf))
+		w.buf = append(w.buf, p[:chunk]...)
+		p = p[chunk:]
+		if len(w.buf) == s3PartSize {
+			if err := w.uploadPart(); err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+	return n, nil
+}
+
+// uploadPart sends the buffered data as the next part
+func (w *s3MultipartWriter) uploadPart() error {
+	number := len(w.parts) + 1
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {w.uploadID}}
+	_, header, err := w.c.do("PUT", w.c.objectURL(w.bucket, w.key, query), w.buf)
+	if err != nil {
+		return fmt.Errorf("uploading part %d: %w", number, err)
+	}
+	w.parts = append(w.parts, s3CompletedPart{PartNumber: number, ETag: header.Get("ETag")})
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// Close uploads the last part and completes the upload
+func (w *s3MultipartWriter) Close() error {
+	// Every upload needs a part, even an empty one
+	if len(w.buf) > 0 || len(w.parts) == 0 {
+		if err := w.uploadPart(); err != nil {
+			w.Abort()
+			return err
+		}
+	}
+
+	complete, err := xml.Marshal(struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}{Parts: w.parts})
+	if err != nil {
+		return err
+	}
+	body, _, err := w.c.do("POST", w.c.objectURL(w.bucket, w.key, url.Values{"uploadId": {w.uploadID}}), complete)
+	if err == nil {
+		var result s3Error
+		if xml.Unmarshal(body, &result) == nil && result.XMLName.Local == "Error" {
+			err = fmt.Errorf("%s: %s", result.Code, result.Message)
+		}
+	}
+	if err != nil {
+		w.Abort()
+		return fmt.Errorf("completing S3 upload: %w", err)
+	}
+	return nil
+}
+
+// Abort cancels the upload, discarding the uploaded parts
+func (w *s3MultipartWriter) Abort() error {
+	_, _, err := w.c.do("DELETE", w.c.objectURL(w.bucket, w.key, url.Values{"uploadId": {w.uploadID}}), nil)
+	return err
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n] + "..."
+	}
+	return s
+}
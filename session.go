@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"sync"
+	"time"
+)
+
+// sessionCacheBytes bounds the responses a Session keeps, so a long batch
+// doesn't hold every playlist in memory
+const sessionCacheBytes = 64 * 1024 * 1024
+
+// sessionCacheTTL is how long a Session answers from a cached response. The
+// playlists and the playlist URLs in player configs carry signed tokens that
+// expire, so late in a long batch they are fetched again.
+const sessionCacheTTL = 10 * time.Minute
+
+// Session is what the Downloaders of one -batch run share. The auth context
+// is kept per host: the cookie jar sends the cookies a host sets for one
+// entry with the next, and the query token segment URLs of the host were
+// given is added to those of a later entry whose playlist URL has none. On
+// top of that, the player configs and playlists fetched in the last
+// sessionCacheTTL are kept by their URL. It lives in memory for the run only.
+type Session struct {
+	client *http.Client
+	ttl    time.Duration
+
+	mu        sync.Mutex
+	queries   map[string]string // Segment query token by host
+	responses map[string]sessionResponse
+	size      int
+	hits      int
+	misses    int
+}
+
+// sessionResponse is a fetched document and the URL it came from after
+// redirects
+type sessionResponse struct {
+	data     []byte
+	finalURL string
+	fetched  time.Time
+}
+
+// newSession returns a Session whose requests go through the transport of
+// base, so connections stay pooled with the other requests of the run. A nil
+// base is the shared httpClient.
+func newSession(base *http.Client) *Session {
+	if base == nil {
+		base = httpClient
+	}
+	client := *base
+	// cookiejar.New only fails for invalid options
+	client.Jar, _ = cookiejar.New(nil)
+	return &Session{
+		client:    &client,
+		ttl:       sessionCacheTTL,
+		queries:   make(map[string]string),
+		responses: make(map[string]sessionResponse),
+	}
+}
+
+// hostQuery returns the segment query token an earlier entry of host used
+func (s *Session) hostQuery(host string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queries[host]
+}
+
+// setHostQuery records query as the segment query token of host
+func (s *Session) setHostQuery(host, query string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queries[host] = query
+}
+
+// lookup returns the response cached for urlStr, counting the hit or miss.
+// A response older than the TTL is dropped and counts as a miss.
+func (s *Session) lookup(urlStr string) (sessionResponse, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resp, ok := s.responses[urlStr]
+	if ok && time.Since(resp.fetched) > s.ttl {
+		delete(s.responses, urlStr)
+		s.size -= len(resp.data)
+		ok = false
+	}
+	if ok {
+		s.hits++
+	} else {
+		s.misses++
+	}
+	return resp, ok
+}
+
+// store caches the response for urlStr while there is room
+func (s *Session) store(urlStr string, data []byte, finalURL string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.responses[urlStr]; ok || s.size+len(data) > sessionCacheBytes {
+		return
+	}
+	s.responses[urlStr] = sessionResponse{data: data, finalURL: finalURL, fetched: time.Now()}
+	s.size += len(data)
+}
+
+// stats returns the cache hits and misses so far
+func (s *Session) stats() (hits, misses int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hits, s.misses
+}
+
+// fetchCached is fetchWithRetry answered from the Session when the same URL
+// was fetched before in the run. Fetches that must reach the server, like
+// those for fresh tokens, use fetchWithRetry.
+func (d *Downloader) fetchCached(urlStr string) (data []byte, finalURL string, err error) {
+	if d.Session == nil {
+		return d.fetchWithRetry(urlStr)
+	}
+	if resp, ok := d.Session.lookup(urlStr); ok {
+		logger.Debug("session cache hit", "url", redactURL(urlStr))
+		return resp.data, resp.finalURL, nil
+	}
+	data, finalURL, err = d.fetchWithRetry(urlStr)
+	if err == nil {
+		d.Session.store(urlStr, data, finalURL)
+	}
+	return data, finalURL, err
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSessionCachesByURL(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		fmt.Fprintf(w, "response for %s", r.URL.Path)
+	}))
+	defer srv.Close()
+
+	session := newSession(srv.Client())
+	d := &Downloader{Concurrent: 1, Session: session}
+	for _, path := range []string{"/a", "/b", "/a", "/a"} {
+		data, _, err := d.fetchCached(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "response for " + path; string(data) != want {
+			t.Errorf("fetchCached(%s) = %q, want %q", path, data, want)
+		}
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("%d requests, want 2", got)
+	}
+	if hits, misses := session.stats(); hits != 2 || misses != 2 {
+		t.Errorf("stats = %d hits, %d misses, want 2 and 2", hits, misses)
+	}
+}
+
+func TestSessionExpiresResponses(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "response %d", requests.Add(1))
+	}))
+	defer srv.Close()
+
+	session := newSession(srv.Client())
+	session.ttl = time.Millisecond
+	d := &Downloader{Concurrent: 1, Session: session}
+	first, _, err := d.fetchCached(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	second, _, err := d.fetchCached(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(first) == string(second) {
+		t.Errorf("an expired response was served again: %q", second)
+	}
+	if session.size != len(second) {
+		t.Errorf("cache holds %d bytes, want %d for the fresh response", session.size, len(second))
+	}
+}
+
+func TestSessionSharesCookies(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			http.SetCookie(w, &http.Cookie{Name: "vuid", Value: "42"})
+			return
+		}
+		if c, err := r.Cookie("vuid"); err != nil || c.Value != "42" {
+			http.Error(w, "no cookie", http.StatusForbidden)
+		}
+	}))
+	defer srv.Close()
+
+	session := newSession(srv.Client())
+	if _, _, err := (&Downloader{Session: session}).fetchCached(srv.URL + "/login"); err != nil {
+		t.Fatal(err)
+	}
+	// Another entry of the batch, with its own Downloader
+	if _, _, err := (&Downloader{Session: session}).fetchCached(srv.URL + "/config"); err != nil {
+		t.Errorf("cookie not sent to the next Downloader: %v", err)
+	}
+}
+
+func TestSessionReusesHostQuery(t *testing.T) {
+	t.Setenv("PATH", "")
+	playlist, err := json.Marshal(Playlist{ClipID: "clip", Audio: []Stream{testStream("a", 3)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/playlist.json" {
+			w.Write(playlist)
+			return
+		}
+		segmentHandler(func(r *http.Request) bool {
+			return r.URL.Query().Get("hmac") != "x"
+		}).ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	session := newSession(srv.Client())
+	dir := t.TempDir()
+	for i, playlistURL := range []string{srv.URL + "/playlist.json?exp=1&hmac=x", srv.URL + "/playlist.json"} {
+		opts := testOptions(t)
+		opts.Concurrent = 1
+		opts.SubsFormat = "vtt"
+		opts.session = session
+		opts.PlaylistURL = playlistURL
+		opts.OutputFile = filepath.Join(dir, fmt.Sprintf("out%d.mp4", i))
+		if err := downloadVideo(opts); err != nil {
+			t.Fatalf("entry %d: %v", i, err)
+		}
+	}
+
+	// Outside a batch nothing is remembered
+	opts := testOptions(t)
+	opts.Concurrent = 1
+	opts.SubsFormat = "vtt"
+	opts.PlaylistURL = srv.URL + "/playlist.json"
+	opts.OutputFile = filepath.Join(dir, "alone.mp4")
+	if err := downloadVideo(opts); err == nil {
+		t.Error("the token was added without a session")
+	}
+}
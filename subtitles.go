@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// TextTrack is a caption or subtitle track from the player config
+type TextTrack struct {
+	ID    int64  `json:"id"`
+	Lang  string `json:"lang"`
+	Label string `json:"label"`
+	Kind  string `json:"kind"` // "subtitles" or "captions"
+	URL   string `json:"url"`  // WebVTT, usually relative to the config URL
+}
+
+// Subtitle is a downloaded text track ready to be embedded or saved
+type Subtitle struct {
+	Track TextTrack
+	VTT   []byte
+}
+
+// selectTextTracks returns the tracks whose language is in langs, a comma
+// separated list where "en" also matches "en-US". An empty langs selects
+// every track.
+func selectTextTracks(tracks []TextTrack, langs string) []TextTrack {
+	if strings.TrimSpace(langs) == "" {
+		return tracks
+	}
+	var selected []TextTrack
+	for _, t := range tracks {
+		for _, lang := range strings.Split(langs, ",") {
+			lang = strings.ToLower(strings.TrimSpace(lang))
+			trackLang := strings.ToLower(t.Lang)
+			if lang != "" && (trackLang == lang || strings.HasPrefix(trackLang, lang+"-")) {
+				selected = append(selected, t)
+				break
+			}
+		}
+	}
+	return selected
+}
+
+// textTrackURL resolves the track URL against the player config URL it was
+// listed in
+func textTrackURL(configURL string, t TextTrack) (string, error) {
+	base, err := url.Parse(configURL)
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(t.URL)
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(ref).String(), nil
+}
+
+// downloadSubtitles fetches the given tracks
+func (d *Downloader) downloadSubtitles(configURL string, tracks []TextTrack) ([]Subtitle, error) {
+	var subs []Subtitle
+	for _, t := range tracks {
+		trackURL, err := textTrackURL(configURL, t)
+		if err != nil {
+			return nil, fmt.Errorf("%s subtitles: %w", t.Lang, err)
+		}
+		data, err := d.fetchURL(trackURL)
+		if err != nil {
+			return nil, fmt.Errorf("fetching %s subtitles: %w", t.Lang, err)
+		}
+		subs = append(subs, Subtitle{Track: t, VTT: data})
+	}
+	return subs, nil
+}
+
+// textTracks returns the text tracks of config, which may be nil
+func textTracks(config *PlayerConfig) []TextTrack {
+	if config == nil {
+		return nil
+	}
+	return config.Request.TextTracks
+}
+
+// fetchSubtitles downloads the tracks of src matching langs. Subtitles are
+// an extra, so problems are warnings and the download goes on without them.
+func fetchSubtitles(d *Downloader, src *playlistSource, langs string) []Subtitle {
+	if src.config == nil {
+		warnf("subtitles are only listed in player configs, -url must be a player config URL for -subs")
+		return nil
+	}
+	tracks := selectTextTracks(src.config.Request.TextTracks, langs)
+	if len(tracks) == 0 {
+		warnf("no subtitles found for -subs-lang %q", langs)
+		return nil
+	}
+	subs, err := d.downloadSubtitles(src.configURL, tracks)
+	if err != nil {
+		warnf("could not fetch subtitles: %v", err)
+		return nil
+	}
+	for _, sub := range subs {
+		infof("Subtitles: %s (%s)", sub.Track.Lang, sub.Track.Label)
+	}
+	return subs
+}
+
+// writeSubtitleSidecars saves subs next to the output as
+// <outputBase>.<lang>.<format>
+func writeSubtitleSidecars(outputBase string, subs []Subtitle, format string, client *http.Client) {
+	used := make(map[string]bool)
+	for _, sub := range subs {
+		name := sub.Track.Lang
+		if name == "" || used[name] {
+			// Tracks can share a language, e.g. subtitles and captions
+			name = strings.TrimPrefix(name+"."+strconv.FormatInt(sub.Track.ID, 10), ".")
+		}
+		used[name] = true
+
+		data := sub.VTT
+		if format == "srt" {
+			data = vttToSRT(data)
+		}
+		sidecar := outputBase + "." + name + "." + format
+		if err := saveOutput(sidecar, data, client); err != nil {
+			warnf("could not write subtitles: %v", err)
+		} else {
+			infof("Subtitles saved to: %s", sidecar)
+		}
+	}
+}
+
+// subtitleCodec returns the ffmpeg subtitle encoder for embedding into c
+func subtitleCodec(c Container) string {
+	switch c.Muxer {
+	case "mp4", "mov":
+		return "mov_text"
+	case "webm":
+		return "webvtt"
+	}
+	return "srt"
+}
+
+var (
+	vttTiming = regexp.MustCompile(`^((?:\d+:)?\d{2}:\d{2}\.\d{3})\s+-->\s+((?:\d+:)?\d{2}:\d{2}\.\d{3})`)
+	// SRT only knows <i>, <b>, and <u>, other WebVTT tags like <v Speaker>
+	// and <c.class> are dropped
+	vttTag = regexp.MustCompile(`</?([a-zA-Z]+)[^>]*>`)
+)
+
+// vttToSRT converts WebVTT to SubRip, keeping the cue timings and text and
+// dropping the header, NOTE/STYLE/REGION blocks, cue settings, and tags
+// SubRip doesn't support
+func vttToSRT(vtt []byte) []byte {
+	var out strings.Builder
+	scanner := bufio.NewScanner(strings.NewReader(strings.ReplaceAll(string(vtt), "\r\n", "\n")))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	n := 0
+	inCue := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			if inCue {
+				out.WriteString("\n")
+			}
+			inCue = false
+			continue
+		}
+		if inCue {
+			out.WriteString(vttTag.ReplaceAllStringFunc(line, func(tag string) string {
+				switch strings.ToLower(vttTag.FindStringSubmatch(tag)[1]) {
+				case "i", "b", "u":
+					return tag
+				}
+				return ""
+			}) + "\n")
+			continue
+		}
+		if m := vttTiming.FindStringSubmatch(line); m != nil {
+			n++
+			fmt.Fprintf(&out, "%d\n%s --> %s\n", n, srtTimestamp(m[1]), srtTimestamp(m[2]))
+			inCue = true
+		}
+		// Anything else outside a cue is the header, a cue identifier, or
+		// a NOTE/STYLE/REGION block
+	}
+	if inCue {
+		out.WriteString("\n")
+	}
+	return []byte(out.String())
+}
+
+// srtTimestamp turns a WebVTT "mm:ss.ttt" or "hh:mm:ss.ttt" timestamp into
+// SubRip's "hh:mm:ss,ttt"
+func srtTimestamp(ts string) string {
+	if strings.Count(ts, ":") == 1 {
+		ts = "00:" + ts
+	}
+	if len(ts) < len("00:00:00.000") {
+		ts = "0" + ts
+	}
+	return strings.Replace(ts, ".", ",", 1)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// outputPlaceholders are the placeholders of -output-template
+var outputPlaceholders = []string{"clip_id", "index", "width", "height", "bitrate", "codec"}
+
+// templateCodecs are the names {codec} expands to, checked in order
+var templateCodecs = []string{"av1", "hevc", "h264", "vp9", "vp8"}
+
+// validateOutputTemplate checks that template only uses known placeholders
+func validateOutputTemplate(template string) error {
+	rest := template
+	for {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			return fmt.Errorf("invalid -output-template %q: unclosed {", template)
+		}
+		name := rest[start+1 : start+end]
+		known := false
+		for _, placeholder := range outputPlaceholders {
+			known = known || name == placeholder
+		}
+		if !known {
+			return fmt.Errorf("unknown placeholder {%s} in -output-template (use {%s})", name, strings.Join(outputPlaceholders, "}, {"))
+		}
+		rest = rest[start+end+1:]
+	}
+	return nil
+}
+
+// expandOutputTemplate names the output of a download after template. The
+// stream placeholders come from video, or audio for an audio-only download,
+// and {index} is that stream's index in the playlist, as -list shows it and
+// -video-index or -audio-index take it.
+func expandOutputTemplate(template, clipID string, index int, video, audio *Stream) (string, error) {
+	stream := video
+	if stream == nil {
+		stream = audio
+	}
+	values := map[string]string{"clip_id": clipID, "index": strconv.Itoa(index)}
+	if stream != nil {
+		values["width"] = strconv.Itoa(stream.Width)
+		values["height"] = strconv.Itoa(stream.Height)
+		values["bitrate"] = strconv.Itoa(stream.Bitrate / 1000)
+		values["codec"] = templateCodec(stream.Codecs)
+	}
+	var pairs []string
+	for _, placeholder := range outputPlaceholders {
+		pairs = append(pairs, "{"+placeholder+"}", values[placeholder])
+	}
+	output := strings.NewReplacer(pairs...).Replace(template)
+
+	// Directories may come from the template, the names in between must
+	// be valid on common filesystems
+	for _, name := range strings.Split(filepath.ToSlash(strings.TrimPrefix(output, filepath.VolumeName(output))), "/") {
+		if strings.ContainsAny(name, `\:*?"<>|`) || strings.ContainsFunc(name, unicode.IsControl) {
+			return "", fmt.Errorf("-output-template gives %q, which has characters that aren't allowed in file names", output)
+		}
+	}
+	if name := filepath.Base(output); strings.HasSuffix(filepath.ToSlash(output), "/") || name == "." || strings.TrimSuffix(name, filepath.Ext(name)) == "" {
+		return "", fmt.Errorf("-output-template gives %q, which has no file name", output)
+	}
+	return output, nil
+}
+
+// templateCodec is the {codec} of a stream, the -codec name of its codec or
+// the codec string's first part
+func templateCodec(codecs string) string {
+	for _, name := range templateCodecs {
+		if hasCodecPrefix(codecs, codecNames[name]) {
+			return name
+		}
+	}
+	codec, _, _ := strings.Cut(codecs, ".")
+	return codec
+}
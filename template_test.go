@@ -0,0 +1,83 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateOutputTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		ok       bool
+	}{
+		{"{clip_id}_{height}p.mp4", true},
+		{"{index}/{width}x{height}_{bitrate}k_{codec}", true},
+		{"plain.mp4", true},
+		{"{title}.mp4", false},
+		{"{clip_id.mp4", false},
+		{"{}.mp4", false},
+	}
+	for _, tt := range tests {
+		if err := validateOutputTemplate(tt.template); (err == nil) != tt.ok {
+			t.Errorf("validateOutputTemplate(%q) = %v, want ok %v", tt.template, err, tt.ok)
+		}
+	}
+}
+
+func TestExpandOutputTemplate(t *testing.T) {
+	video := &Stream{Width: 1920, Height: 1080, Bitrate: 4500000, Codecs: "avc1.640028"}
+	audio := &Stream{Bitrate: 128000, Codecs: "mp4a.40.2"}
+	tests := []struct {
+		name     string
+		template string
+		index    int
+		video    *Stream
+		want     string
+	}{
+		{"video", "{clip_id}_{height}p.mp4", 0, video, "123_1080p.mp4"},
+		{"bitrate in kbps", "{width}x{height}_{bitrate}k_{codec}", 2, video, "1920x1080_4500k_h264"},
+		{"stream index", "{clip_id}-{index}.mkv", 3, video, "123-3.mkv"},
+		{"audio only", "{clip_id}_{bitrate}k_{codec}.m4a", 1, nil, "123_128k_mp4a.m4a"},
+		{"directories", filepath.Join("{clip_id}", "{height}p.mp4"), 0, video, filepath.Join("123", "1080p.mp4")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandOutputTemplate(tt.template, "123", tt.index, tt.video, audio)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("expandOutputTemplate(%q) = %q, want %q", tt.template, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandOutputTemplateInvalid(t *testing.T) {
+	for _, clipID := range []string{"a:b", "a?b", "a\x01b"} {
+		if got, err := expandOutputTemplate("{clip_id}.mp4", clipID, 0, nil, nil); err == nil {
+			t.Errorf("clip ID %q expanded to %q, want an error", clipID, got)
+		}
+	}
+	for _, template := range []string{"{clip_id}.mp4", "out/{clip_id}"} {
+		if got, err := expandOutputTemplate(template, "", 0, nil, nil); err == nil {
+			t.Errorf("%q with no clip ID expanded to %q, want an error", template, got)
+		}
+	}
+}
+
+func TestTemplateCodec(t *testing.T) {
+	tests := map[string]string{
+		"avc1.640028":     "h264",
+		"hvc1.1.6.L93.B0": "hevc",
+		"av01.0.08M.08":   "av1",
+		"vp09.00.40.08":   "vp9",
+		"opus":            "opus",
+		"mp4a.40.2":       "mp4a",
+	}
+	for codecs, want := range tests {
+		if got := templateCodec(codecs); got != want {
+			t.Errorf("templateCodec(%q) = %q, want %q", codecs, got, want)
+		}
+	}
+}
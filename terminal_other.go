@@ -0,0 +1,23 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !windows
+
+package main
+
+import "os"
+
+// isTerminal reports whether f is a character device, the best available
+// approximation of a terminal on this platform
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// terminalWidth can't ask the terminal here, leaving it to $COLUMNS
+func terminalWidth(f *os.File) int {
+	return 0
+}
+
+// enableTerminalEscapes reports false, as nothing is known about the
+// terminal's escape sequences here
+func enableTerminalEscapes(f *os.File) bool {
+	return false
+}
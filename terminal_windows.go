@@ -0,0 +1,57 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	kernel32                       = syscall.NewLazyDLL("kernel32.dll")
+	procGetConsoleMode             = kernel32.NewProc("GetConsoleMode")
+	procSetConsoleMode             = kernel32.NewProc("SetConsoleMode")
+	procGetConsoleScreenBufferInfo = kernel32.NewProc("GetConsoleScreenBufferInfo")
+)
+
+// enableVirtualTerminalProcessing makes the console interpret ANSI escape
+// sequences, supported since Windows 10
+const enableVirtualTerminalProcessing = 0x0004
+
+// isTerminal reports whether f is connected to a console
+func isTerminal(f *os.File) bool {
+	var mode uint32
+	r, _, _ := procGetConsoleMode.Call(f.Fd(), uintptr(unsafe.Pointer(&mode)))
+	return r != 0
+}
+
+// terminalWidth returns the width of the console window f is connected
+// to, or 0 if it can't be told
+func terminalWidth(f *os.File) int {
+	var info struct {
+		size, cursorPosition     struct{ x, y int16 }
+		attributes               uint16
+		left, top, right, bottom int16
+		maximumWindowSize        struct{ x, y int16 }
+	}
+	r, _, _ := procGetConsoleScreenBufferInfo.Call(f.Fd(), uintptr(unsafe.Pointer(&info)))
+	if r == 0 {
+		return 0
+	}
+	return int(info.right-info.left) + 1
+}
+
+// enableTerminalEscapes turns on ANSI escape sequences for the console f
+// is connected to, reporting whether the console supports them
+func enableTerminalEscapes(f *os.File) bool {
+	var mode uint32
+	if r, _, _ := procGetConsoleMode.Call(f.Fd(), uintptr(unsafe.Pointer(&mode))); r == 0 {
+		return false
+	}
+	if mode&enableVirtualTerminalProcessing != 0 {
+		return true
+	}
+	r, _, _ := procSetConsoleMode.Call(f.Fd(), uintptr(mode|enableVirtualTerminalProcessing))
+	return r != 0
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// timelineTolerance is how far apart, in seconds, the end of a segment and
+// the start of the next may be before -verify-timeline reports a gap or an
+// overlap. Playlists round the timestamps, so they rarely line up exactly.
+const timelineTolerance = 0.1
+
+// checkTimeline returns the segments ordered by start time, a copy if they
+// weren't, and a description of each gap, overlap, or backwards segment
+func checkTimeline(segments []Segment) ([]Segment, []string) {
+	var issues []string
+	for i, seg := range segments {
+		if seg.End < seg.Start {
+			issues = append(issues, fmt.Sprintf("segment %d ends at %.3fs before it starts at %.3fs", i, seg.End, seg.Start))
+		}
+	}
+
+	sorted := segments
+	if !sort.SliceIsSorted(segments, func(i, j int) bool { return segments[i].Start < segments[j].Start }) {
+		sorted = make([]Segment, len(segments))
+		copy(sorted, segments)
+		sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Start < sorted[j].Start })
+		issues = append(issues, "segments are out of order")
+	}
+
+	for i := 1; i < len(sorted); i++ {
+		prev, seg := sorted[i-1], sorted[i]
+		switch diff := seg.Start - prev.End; {
+		case diff > timelineTolerance:
+			issues = append(issues, fmt.Sprintf("%.3fs gap at %.3fs", diff, prev.End))
+		case diff < -timelineTolerance:
+			issues = append(issues, fmt.Sprintf("%.3fs overlap at %.3fs", -diff, seg.Start))
+		}
+	}
+	return sorted, issues
+}
+
+// verifyTimeline checks the timeline of stream for -verify-timeline,
+// warning about each issue or, if strict, failing on them. The returned
+// stream has its segments in start time order.
+func verifyTimeline(kind StreamKind, stream *Stream, strict bool) (*Stream, error) {
+	if stream == nil {
+		return nil, nil
+	}
+	sorted, issues := checkTimeline(stream.Segments)
+	if len(issues) == 0 {
+		return stream, nil
+	}
+	if strict {
+		if len(issues) > 1 {
+			return nil, fmt.Errorf("%s timeline: %s, and %d more issues", kind, issues[0], len(issues)-1)
+		}
+		return nil, fmt.Errorf("%s timeline: %s", kind, issues[0])
+	}
+
+	// A badly broken playlist can have an issue per segment
+	const maxReported = 5
+	for i, issue := range issues {
+		if i == maxReported {
+			warnf("%s timeline: %d more issues", kind, len(issues)-maxReported)
+			break
+		}
+		warnf("%s timeline: %s", kind, issue)
+	}
+	if len(sorted) > 0 && &sorted[0] == &stream.Segments[0] {
+		return stream, nil
+	}
+	warnf("%s timeline: writing the segments by start time", kind)
+	reordered := *stream
+	reordered.Segments = sorted
+	return &reordered, nil
+}
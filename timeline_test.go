@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckTimeline(t *testing.T) {
+	ordered := testStream("v", 5).Segments
+	shuffled := []Segment{ordered[2], ordered[0], ordered[4], ordered[1], ordered[3]}
+	gapped := []Segment{ordered[0], ordered[1], ordered[3], ordered[4]}
+	overlapping := []Segment{{Start: 0, End: 2}, {Start: 1.5, End: 3}}
+	rounded := []Segment{{Start: 0, End: 1.96}, {Start: 2, End: 4}}
+	backwards := []Segment{{Start: 0, End: 1}, {Start: 1, End: 0.5}}
+
+	tests := []struct {
+		name     string
+		segments []Segment
+		issues   []string
+	}{
+		{"ordered", ordered, nil},
+		{"shuffled", shuffled, []string{"out of order"}},
+		{"gapped", gapped, []string{"1.000s gap at 2.000s"}},
+		{"overlapping", overlapping, []string{"0.500s overlap at 1.500s"}},
+		{"within the tolerance", rounded, nil},
+		{"backwards", backwards, []string{"segment 1 ends at 0.500s before it starts at 1.000s"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sorted, issues := checkTimeline(tt.segments)
+			if len(issues) != len(tt.issues) {
+				t.Fatalf("issues %q, want %q", issues, tt.issues)
+			}
+			for i := range issues {
+				if !strings.Contains(issues[i], tt.issues[i]) {
+					t.Errorf("issue %q, want %q", issues[i], tt.issues[i])
+				}
+			}
+			for i := 1; i < len(sorted); i++ {
+				if sorted[i].Start < sorted[i-1].Start {
+					t.Errorf("segments not sorted: %v", segmentStarts(sorted))
+				}
+			}
+		})
+	}
+
+	// Sorting copies, the playlist's own order is left alone
+	if shuffled[0].Start != 2 {
+		t.Error("checkTimeline reordered its argument")
+	}
+}
+
+func TestVerifyTimeline(t *testing.T) {
+	stream := testStream("v", 4)
+	stream.Segments[1], stream.Segments[2] = stream.Segments[2], stream.Segments[1]
+
+	if _, err := verifyTimeline(VideoStream, &stream, true); err == nil || !strings.Contains(err.Error(), "out of order") {
+		t.Errorf("strict: %v, want an out of order error", err)
+	}
+	reordered, err := verifyTimeline(VideoStream, &stream, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := segmentStarts(reordered.Segments); got[1] != 1 || got[2] != 2 {
+		t.Errorf("segments start at %v, want them in order", got)
+	}
+
+	clean := testStream("a", 3)
+	if got, err := verifyTimeline(AudioStream, &clean, true); err != nil || got != &clean {
+		t.Errorf("a clean timeline: %v, %v, want the stream itself", got, err)
+	}
+	if got, err := verifyTimeline(AudioStream, nil, true); got != nil || err != nil {
+		t.Errorf("no stream: %v, %v", got, err)
+	}
+}
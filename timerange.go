@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// TimeRange is a span of a video in seconds. End is 0 when the range runs
+// to the end of the video.
+type TimeRange struct {
+	Start float64
+	End   float64
+}
+
+// parseTimeRange parses the -start and -end flags, returning nil when
+// neither is set
+func parseTimeRange(start, end string) (*TimeRange, error) {
+	if start == "" && end == "" {
+		return nil, nil
+	}
+
+	r := &TimeRange{}
+	var err error
+	if start != "" {
+		if r.Start, err = parseTimestamp(start); err != nil {
+			return nil, fmt.Errorf("invalid -start: %w", err)
+		}
+	}
+	if end != "" {
+		if r.End, err = parseTimestamp(end); err != nil {
+			return nil, fmt.Errorf("invalid -end: %w", err)
+		}
+		if r.End <= r.Start {
+			return nil, fmt.Errorf("-end %s must be after -start %s", end, start)
+		}
+	}
+	return r, nil
+}
+
+// parseTimestamp parses seconds ("90", "90.5") or a clock time ("1:30",
+// "00:01:30.5") into seconds
+func parseTimestamp(s string) (float64, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("%q is not HH:MM:SS or seconds", s)
+	}
+
+	var seconds float64
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil || v < 0 {
+			return 0, fmt.Errorf("%q is not HH:MM:SS or seconds", s)
+		}
+		// Only the last field may be fractional or exceed 59
+		if i < len(parts)-1 && v != float64(int(v)) {
+			return 0, fmt.Errorf("%q is not HH:MM:SS or seconds", s)
+		}
+		if i > 0 && v >= 60 {
+			return 0, fmt.Errorf("%q has a field of 60 or more", s)
+		}
+		seconds = seconds*60 + v
+	}
+	return seconds, nil
+}
+
+// selectSegmentRange returns the segments that overlap r, in order
+func selectSegmentRange(segments []Segment, r *TimeRange) []Segment {
+	var selected []Segment
+	for _, seg := range segments {
+		if seg.End <= r.Start {
+			continue
+		}
+		if r.End > 0 && seg.Start >= r.End {
+			continue
+		}
+		selected = append(selected, seg)
+	}
+	return selected
+}
+
+// clipStream returns a copy of stream limited to the segments overlapping r.
+// The init segment is kept as it is needed regardless of the range.
+func clipStream(stream *Stream, r *TimeRange) (*Stream, error) {
+	clipped := *stream
+	clipped.Segments = selectSegmentRange(stream.Segments, r)
+	if len(clipped.Segments) == 0 {
+		return nil, fmt.Errorf("no segments in range (stream is %.1fs long)", stream.Duration)
+	}
+	return &clipped, nil
+}
+
+// trimRelativeTo returns r relative to the start of clipped, the stream
+// that sets the output's timeline. The downloaded file starts at its first
+// segment rather than at 0.
+func trimRelativeTo(clipped *Stream, r *TimeRange) *TimeRange {
+	offset := clipped.Segments[0].Start
+	trim := &TimeRange{Start: r.Start - offset}
+	if r.End > 0 {
+		trim.End = r.End - offset
+	}
+	return trim
+}
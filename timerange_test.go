@@ -0,0 +1,110 @@
+package main
+
+import "testing"
+
+// segmentStarts returns the start times of segments
+func segmentStarts(segments []Segment) []float64 {
+	var starts []float64
+	for _, seg := range segments {
+		starts = append(starts, seg.Start)
+	}
+	return starts
+}
+
+func TestParseTimestamp(t *testing.T) {
+	tests := []struct {
+		in   string
+		want float64
+		ok   bool
+	}{
+		{"90", 90, true},
+		{"90.5", 90.5, true},
+		{"1:30", 90, true},
+		{"00:01:30.5", 90.5, true},
+		{"1:00:00", 3600, true},
+		{"1:60", 0, false},
+		{"1.5:30", 0, false},
+		{"-5", 0, false},
+		{"1:2:3:4", 0, false},
+		{"abc", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseTimestamp(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseTimestamp(%q) = %v, %v, want %v, ok %v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestParseTimeRange(t *testing.T) {
+	if r, err := parseTimeRange("", ""); r != nil || err != nil {
+		t.Errorf("no flags = %v, %v, want nil", r, err)
+	}
+	if r, err := parseTimeRange("10", ""); err != nil || *r != (TimeRange{Start: 10}) {
+		t.Errorf("-start only = %v, %v", r, err)
+	}
+	if _, err := parseTimeRange("1:00", "0:30"); err == nil {
+		t.Error("-end before -start accepted")
+	}
+}
+
+func TestSelectSegmentRange(t *testing.T) {
+	segments := testStream("v", 10).Segments // 1 second each, 0-10s
+	tests := []struct {
+		name string
+		r    TimeRange
+		want []float64
+	}{
+		{"inside", TimeRange{Start: 2.5, End: 4.5}, []float64{2, 3, 4}},
+		{"on boundaries", TimeRange{Start: 2, End: 4}, []float64{2, 3}},
+		{"to the end", TimeRange{Start: 8}, []float64{8, 9}},
+		{"from the start", TimeRange{End: 1.5}, []float64{0, 1}},
+		{"past the end", TimeRange{Start: 20}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := segmentStarts(selectSegmentRange(segments, &tt.r))
+			if len(got) != len(tt.want) {
+				t.Fatalf("segments starting at %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("segments starting at %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestClipStream(t *testing.T) {
+	stream := testStream("v", 10)
+	stream.InitSegment = "aW5pdA=="
+	clipped, err := clipStream(&stream, &TimeRange{Start: 3, End: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clipped.InitSegment != stream.InitSegment {
+		t.Errorf("init segment %q, want it kept", clipped.InitSegment)
+	}
+	if len(clipped.Segments) != 2 || clipped.Segments[0].URL != "seg-3.m4s" {
+		t.Errorf("clipped to %v, want segments 3 and 4", clipped.Segments)
+	}
+	if len(stream.Segments) != 10 {
+		t.Errorf("original stream changed to %d segments", len(stream.Segments))
+	}
+
+	if _, err := clipStream(&stream, &TimeRange{Start: 30}); err == nil {
+		t.Error("range past the end clipped without an error")
+	}
+}
+
+func TestTrimRelativeTo(t *testing.T) {
+	stream := testStream("v", 10)
+	clipped, err := clipStream(&stream, &TimeRange{Start: 3.5, End: 5.25})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := trimRelativeTo(clipped, &TimeRange{Start: 3.5, End: 5.25}); *got != (TimeRange{Start: 0.5, End: 2.25}) {
+		t.Errorf("trim = %+v, want 0.5-2.25 into the download", *got)
+	}
+}